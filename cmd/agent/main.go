@@ -8,6 +8,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -16,6 +17,7 @@ import (
 	"os"
 	"reflect"
 	"runtime"
+	"strconv"
 	"time"
 
 	"github.com/fkocharli/metricity/internal/config"
@@ -34,8 +36,11 @@ type MetricValues struct {
 type API struct {
 	Client  *http.Client
 	baseURL string
+	agentID string
 }
 
+var errPayloadTooLarge = errors.New("payload rejected by server as too large")
+
 type Metrics struct {
 	ID    string   `json:"id"`              // имя метрики
 	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
@@ -63,7 +68,7 @@ func main() {
 
 	currentMetricsValue := newMetricValues(getMetricNames())
 
-	RunAgent(currentMetricsValue, cfg.AgentConfig.Key)
+	RunAgent(currentMetricsValue, cfg.AgentConfig.Key, cfg.AgentConfig.ID)
 
 }
 
@@ -111,6 +116,9 @@ func (a *API) makeRequest(m []Metrics, ctx context.Context, path string) (*http.
 	}
 
 	req.Header.Add("Content-Type", "application/json")
+	if a.agentID != "" {
+		req.Header.Add("X-Agent-ID", a.agentID)
+	}
 	//req.Header.Add("Content-Encoding", "gzip")
 
 	return req, nil
@@ -121,15 +129,36 @@ func (a *API) sendMetricsRetryFallback(req, fallbackReq *http.Request) error {
 	retries := 3
 
 	for i := 0; i <= retries; i++ {
+		if i > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			req.Body = body
+		}
+
 		res, err := a.Client.Do(req)
-		if err != nil || res.StatusCode != http.StatusOK {
+		if err != nil {
 			log.Printf("unable send metric for url: %s, \n", req.URL)
 			time.Sleep(time.Second)
 			continue
 		}
 		io.ReadAll(res.Body)
-		defer res.Body.Close()
-		return nil
+		res.Body.Close()
+
+		switch res.StatusCode {
+		case http.StatusOK:
+			return nil
+		case http.StatusRequestEntityTooLarge:
+			return errPayloadTooLarge
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			wait := retryAfter(res.Header.Get("Retry-After"), time.Second)
+			log.Printf("server asked to retry metric for url: %s after %v, \n", req.URL, wait)
+			time.Sleep(wait)
+		default:
+			log.Printf("unable send metric for url: %s, status: %d \n", req.URL, res.StatusCode)
+			time.Sleep(time.Second)
+		}
 	}
 
 	if fallbackReq != nil {
@@ -145,6 +174,23 @@ func (a *API) sendMetricsRetryFallback(req, fallbackReq *http.Request) error {
 	return nil
 }
 
+// retryAfter parses Retry-After given either in seconds or as HTTP date.
+func retryAfter(v string, def time.Duration) time.Duration {
+	if v == "" {
+		return def
+	}
+	if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return def
+}
+
 func newMetricValues(metricList []string) *MetricValues {
 	m := &MetricValues{
 		Gauge:     make(map[string]gauge),
@@ -156,7 +202,7 @@ func newMetricValues(metricList []string) *MetricValues {
 	return m
 }
 
-func RunAgent(metrics *MetricValues, key string) {
+func RunAgent(metrics *MetricValues, key, agentID string) {
 
 	client := http.Client{
 		Timeout: 10 * time.Second,
@@ -165,6 +211,7 @@ func RunAgent(metrics *MetricValues, key string) {
 	api := API{
 		Client:  &client,
 		baseURL: baseURL,
+		agentID: agentID,
 	}
 
 	for {
@@ -203,6 +250,7 @@ func RunAgent(metrics *MetricValues, key string) {
 			req, err := api.makeRequest(metricsBucket, ctx, "updates/")
 			if err != nil {
 				log.Printf("Unable create request.\n Error: %s", err)
+				continue
 			}
 			err = api.sendMetricsRetryFallback(req, nil)
 			if err != nil {
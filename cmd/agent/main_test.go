@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -180,3 +181,38 @@ func sendMetrics(m Metrics, ctx context.Context, baseURL, path string, client *h
 	return body, nil
 
 }
+
+func TestSendHonoursRetryAfter(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.NotEmpty(t, body)
+		assert.Equal(t, "agent-1", r.Header.Get("X-Agent-ID"))
+
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	api := API{Client: ts.Client(), baseURL: ts.URL + "/", agentID: "agent-1"}
+
+	req, err := api.makeRequest([]Metrics{{ID: "PollCount", MType: "counter"}}, context.Background(), "updates/")
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, api.sendMetricsRetryFallback(req, nil))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, 2, calls)
+}
+
+func Test_retryAfter(t *testing.T) {
+	assert.Equal(t, 5*time.Second, retryAfter("5", time.Second))
+	assert.Equal(t, time.Second, retryAfter("", time.Second))
+	assert.Equal(t, time.Second, retryAfter("soon", time.Second))
+}
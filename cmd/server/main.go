@@ -3,20 +3,33 @@ package main
 import (
 	"context"
 	"database/sql"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/fkocharli/metricity/internal/alerting"
 	"github.com/fkocharli/metricity/internal/config"
 	"github.com/fkocharli/metricity/internal/filewriter"
+	"github.com/fkocharli/metricity/internal/forward"
 	"github.com/fkocharli/metricity/internal/handlers"
+	"github.com/fkocharli/metricity/internal/registry"
 	"github.com/fkocharli/metricity/internal/repositories"
 	"github.com/fkocharli/metricity/internal/server"
+	"github.com/fkocharli/metricity/internal/static"
+	"github.com/fkocharli/metricity/internal/storage/boltstorage"
+	"github.com/fkocharli/metricity/internal/storage/cachedstorage"
 	"github.com/fkocharli/metricity/internal/storage/dbstorage"
 	"github.com/fkocharli/metricity/internal/storage/filestorage"
 	"github.com/fkocharli/metricity/internal/storage/memorystorage"
+	"github.com/fkocharli/metricity/internal/storage/sqlitestorage"
+	"github.com/fkocharli/metricity/internal/webhooks"
 )
 
 func main() {
@@ -25,6 +38,15 @@ func main() {
 		log.Println(err)
 		os.Exit(1)
 	}
+
+	if args := flag.Args(); len(args) > 0 && args[0] == "migrate" {
+		if err := runMigrate(cfg.ServerConfig, args[1:]); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	serverCtx, serverCancel := context.WithCancel(context.Background())
 	filerCtx, filerCancel := context.WithCancel(context.Background())
 	group := sync.WaitGroup{}
@@ -32,39 +54,93 @@ func main() {
 	var storager repositories.Storager
 
 	if cfg.ServerConfig.DBDSN != "" {
-		db, err := sql.Open("postgres", cfg.ServerConfig.DBDSN)
+		dbrepo, db, err := openDB(cfg.ServerConfig)
 		if err != nil {
-			log.Printf("Unable to connect to DB. Error: %v", err)
+			panic(err)
 		}
 		defer db.Close()
 
-		dbrepo, err := dbstorage.NewRepository(db)
-		if err != nil {
-			panic(err)
+		// Postgres is durable on its own, so the file only keeps periodic snapshots of its
+		// contents. With DATABASE_SEED they seed the metrics the database is missing, e.g.
+		// when moving from file storage; stored values are never overwritten. The embedded
+		// databases are local files themselves and keep no snapshots.
+		var fileRepo *filestorage.FileStore
+		if backend, _ := dbBackend(cfg.ServerConfig.DBDSN); backend == backendPostgres {
+			fileRepo, err = filestorage.NewRepository(cfg.ServerConfig.StoreFile, cfg.ServerConfig.StoreInterval, cfg.ServerConfig.StoreKeep, cfg.ServerConfig.StoreFormat)
+			if err != nil {
+				log.Printf("Error creating file repo: %v\n", err)
+			}
+		}
+
+		if fileRepo != nil && cfg.ServerConfig.DBSeed {
+			seedCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := filewriter.Seed(seedCtx, fileRepo, dbrepo)
+			cancel()
+			if err != nil {
+				log.Printf("Unable to seed database from file. Error: %v", err)
+			}
+		}
+
+		repo := dbrepo
+
+		if cfg.ServerConfig.DBCache {
+			cachedRepo, err := cachedstorage.NewRepository(context.Background(), dbrepo, cfg.ServerConfig.DBFlushInterval)
+			if err != nil {
+				panic(err)
+			}
+			repo = cachedRepo
+
+			group.Add(1)
+			go func() {
+				defer group.Done()
+				if err := cachedRepo.Run(filerCtx); err != nil {
+					log.Printf("cache flush error: %v", err)
+				}
+			}()
 		}
 
-		storager = repositories.NewStorager(dbrepo, nil, cfg.ServerConfig.Key)
+		storager = repositories.NewStorager(repo, nil, cfg.ServerConfig.Key)
+
+		if fileRepo != nil {
+			defer fileRepo.Close()
+			wr, err := filewriter.New(fileRepo, storager.Repo, cfg.ServerConfig.StoreInterval, cfg.ServerConfig.CompactInterval, false)
+			if err != nil {
+				log.Println(err)
+				os.Exit(1)
+			}
 
-		// if cfg.ServerConfig.StoreFile != "" && cfg.ServerConfig.Restore {
-		// 	fileRepo, err := filestorage.NewRepository(cfg.ServerConfig.StoreFile, cfg.ServerConfig.StoreInterval)
-		// 	if err != nil {
-		// 		log.Printf("Error creating file repo: %v\n", err)
-		// 	}
-		// 	wr := filewriter.New(fileRepo, storager.Repo, cfg.ServerConfig.StoreInterval, cfg.ServerConfig.Restore)
-		// 	wr.Load()
-		// }
+			group.Add(1)
+			go func() {
+				defer group.Done()
+				if err := wr.Run(filerCtx); err != nil {
+					log.Printf("filewriter run error: %v", err)
+					filerCancel()
+				}
+			}()
+		}
 	} else {
-		memRepo := memorystorage.NewRepository()
-		fileRepo, err := filestorage.NewRepository(cfg.ServerConfig.StoreFile, cfg.ServerConfig.StoreInterval)
+		// The sharded store only pays off with many cores updating at once, so the
+		// single mutex store stays the default.
+		var memRepo repositories.Storage = memorystorage.NewRepository()
+		if cfg.ServerConfig.MemoryShards > 0 {
+			memRepo = memorystorage.NewShardedRepository(cfg.ServerConfig.MemoryShards)
+		}
+		fileRepo, err := filestorage.NewRepository(cfg.ServerConfig.StoreFile, cfg.ServerConfig.StoreInterval, cfg.ServerConfig.StoreKeep, cfg.ServerConfig.StoreFormat)
 		if err != nil {
 			log.Printf("Error creating file repo: %v\n", err)
 		}
 
-		storager = repositories.NewStorager(memRepo, fileRepo, cfg.ServerConfig.Key)
+		// A nil *FileStore must not end up in the FileRepository interface, where it
+		// wouldn't compare equal to nil and every update would call Sync on it.
+		storager = repositories.NewStorager(memRepo, nil, cfg.ServerConfig.Key)
 		if fileRepo != nil {
-			defer storager.FileRepo.FileReaderClose()
-			defer storager.FileRepo.FileWriterClose()
-			wr := filewriter.New(fileRepo, storager.Repo, cfg.ServerConfig.StoreInterval, cfg.ServerConfig.Restore)
+			storager.FileRepo = fileRepo
+			defer storager.FileRepo.Close()
+			wr, err := filewriter.New(fileRepo, storager.Repo, cfg.ServerConfig.StoreInterval, cfg.ServerConfig.CompactInterval, cfg.ServerConfig.Restore)
+			if err != nil {
+				log.Println(err)
+				os.Exit(1)
+			}
 
 			group.Add(1)
 			go func() {
@@ -77,14 +153,119 @@ func main() {
 		}
 	}
 
-	handler := handlers.NewHandler(storager)
+	// Without a registry file metadata set via /meta/ is only kept in memory.
+	if cfg.ServerConfig.RegistryFile != "" {
+		storager.Registry, err = registry.Load(cfg.ServerConfig.RegistryFile, cfg.ServerConfig.RegistryStrict)
+	} else {
+		storager.Registry, err = registry.New(nil, cfg.ServerConfig.RegistryStrict)
+	}
+	if err != nil {
+		log.Printf("Unable to load metric registry. Error: %v", err)
+		os.Exit(1)
+	}
 
-	serv := server.New(cfg.ServerConfig.Address, handler.Mux)
+	storager.Broker = repositories.NewBroker()
+
+	if cfg.ServerConfig.HistorySize > 0 && cfg.ServerConfig.HistoryInterval > 0 {
+		storager.History = repositories.NewHistory(cfg.ServerConfig.HistorySize)
+
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			storager.History.Run(serverCtx, cfg.ServerConfig.HistoryInterval, &storager)
+		}()
+	}
+
+	// Relay mode: accepted updates are also sent to the upstream servers, signed with
+	// FORWARD_KEY or, if it isn't set, with the key of this server.
+	forwardKey := cfg.ServerConfig.ForwardKey
+	if forwardKey == "" {
+		forwardKey = cfg.ServerConfig.Key
+	}
+	for _, address := range cfg.ServerConfig.ForwardTo {
+		upstream, err := forward.New(address, forwardKey, cfg.ServerConfig.ForwardInterval, cfg.ServerConfig.ForwardBatchSize)
+		if err != nil {
+			log.Printf("Unable to forward to %s. Error: %v", address, err)
+			os.Exit(1)
+		}
+		storager.Forwarders = append(storager.Forwarders, upstream)
+
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			upstream.Run(serverCtx)
+		}()
+	}
+
+	templates, err := static.Templates(cfg.ServerConfig.TemplateDir)
+	if err != nil {
+		log.Printf("Unable to parse page templates. Error: %v", err)
+		os.Exit(1)
+	}
+
+	handler := handlers.NewHandler(storager, cfg.ServerConfig, templates)
+	handler.TrustedProxies, err = handlers.ParseTrustedProxies(cfg.ServerConfig.TrustedProxies)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	if cfg.ServerConfig.AlertRules != "" {
+		rules, err := alerting.LoadRules(cfg.ServerConfig.AlertRules)
+		if err != nil {
+			log.Printf("Unable to load alert rules. Error: %v", err)
+			os.Exit(1)
+		}
+
+		notifiers := []alerting.Notifier{alerting.LogNotifier{}}
+		if cfg.ServerConfig.AlertWebhook != "" {
+			notifiers = append(notifiers, alerting.NewWebhookNotifier(cfg.ServerConfig.AlertWebhook))
+		}
+
+		handler.Alerts, err = alerting.New(rules, &storager, cfg.ServerConfig.AlertInterval, notifiers...)
+		if err != nil {
+			log.Printf("Unable to load alert rules. Error: %v", err)
+			os.Exit(1)
+		}
+
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			handler.Alerts.Run(serverCtx)
+		}()
+	}
+
+	// Without a webhooks file subscriptions are only kept in memory.
+	handler.Webhooks, err = webhooks.New(cfg.ServerConfig.WebhooksFile, storager.Broker)
+	if err != nil {
+		log.Printf("Unable to load webhook subscriptions. Error: %v", err)
+		os.Exit(1)
+	}
+	handler.Webhooks.Retries = cfg.ServerConfig.WebhookRetries
+	handler.Webhooks.Backoff = cfg.ServerConfig.WebhookBackoff
+	if cfg.ServerConfig.WebhookDeadLetters != "" {
+		deadLetters, err := os.OpenFile(cfg.ServerConfig.WebhookDeadLetters, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Printf("Unable to open webhook dead letter log. Error: %v", err)
+			os.Exit(1)
+		}
+		defer deadLetters.Close()
+		handler.Webhooks.DeadLetters = deadLetters
+	}
 
 	group.Add(1)
+	go func() {
+		defer group.Done()
+		handler.Webhooks.Run(serverCtx)
+	}()
+
+	serv := server.New(cfg.ServerConfig.Address, handler.Mux)
 
+	group.Add(1)
+	served := make(chan struct{})
 	go func() {
 		defer group.Done()
+		defer close(served)
 		if err := serv.Run(serverCtx); err != nil {
 			log.Printf("server run error: %v", err)
 			serverCancel()
@@ -99,7 +280,12 @@ func main() {
 		log.Printf("service stoped by signal: %v", sig)
 
 		log.Printf("Shutting down server\n")
+		// Streams never end on their own and would hold up the graceful shutdown.
+		storager.Broker.Close()
 		serverCancel()
+		// Requests still being served write to the cache and the file, so those are
+		// flushed once the server has stopped.
+		<-served
 		log.Printf("Server shuted down\n")
 		log.Printf("Trying to save to file\n")
 		filerCancel()
@@ -108,6 +294,73 @@ func main() {
 	group.Wait()
 }
 
+// Database backends selected by the DATABASE_DSN scheme.
+const (
+	backendPostgres = "postgres"
+	backendSQLite   = "sqlite"
+	backendBolt     = "bolt"
+)
+
+// dbBackend returns the backend selected by the DSN: sqlite:// for a local SQLite file,
+// bolt:// for the embedded key-value store, postgres:// URLs and key=value connection
+// strings for Postgres. Any other scheme is an error.
+func dbBackend(dsn string) (string, error) {
+	if _, ok := sqlitestorage.ParseDSN(dsn); ok {
+		return backendSQLite, nil
+	}
+	if _, ok := boltstorage.ParseDSN(dsn); ok {
+		return backendBolt, nil
+	}
+
+	scheme, _, ok := strings.Cut(dsn, "://")
+	if !ok || scheme == "postgres" || scheme == "postgresql" {
+		return backendPostgres, nil
+	}
+	return "", fmt.Errorf("unsupported database DSN scheme %q, use postgres://, sqlite:// or bolt://", scheme)
+}
+
+// openDB opens the backend selected by the DATABASE_DSN scheme, see dbBackend.
+func openDB(cfg config.ServerConfig) (repositories.Storage, io.Closer, error) {
+	backend, err := dbBackend(cfg.DBDSN)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch backend {
+	case backendBolt:
+		path, _ := boltstorage.ParseDSN(cfg.DBDSN)
+		repo, err := boltstorage.NewRepository(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return repo, repo, nil
+
+	case backendSQLite:
+		path, _ := sqlitestorage.ParseDSN(cfg.DBDSN)
+		db, err := sqlitestorage.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		repo, err := sqlitestorage.NewRepository(db, cfg.DBQueryTimeout)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return repo, db, nil
+	}
+
+	db, err := sql.Open("postgres", cfg.DBDSN)
+	if err != nil {
+		return nil, nil, err
+	}
+	repo, err := dbstorage.NewRepository(db, cfg.DBQueryTimeout)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return repo, db, nil
+}
+
 func waitExitSignal() chan os.Signal {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/config"
+	"github.com/fkocharli/metricity/internal/storage/dbstorage"
+)
+
+const migrateUsage = "usage: server [flags] migrate up | down [steps] | status"
+
+// runMigrate applies or inspects schema migrations of the database given by DATABASE_DSN.
+func runMigrate(cfg config.ServerConfig, args []string) error {
+	if cfg.DBDSN == "" {
+		return errors.New("database DSN is not set")
+	}
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	backend, err := dbBackend(cfg.DBDSN)
+	if err != nil {
+		return err
+	}
+	if backend != backendPostgres {
+		return fmt.Errorf("migrations are only supported for Postgres, %s databases are initialised on startup", backend)
+	}
+
+	db, err := sql.Open("postgres", cfg.DBDSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	switch args[0] {
+	case "up":
+		return dbstorage.MigrateUp(ctx, db)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps: %s", args[1])
+			}
+		}
+		return dbstorage.MigrateDown(ctx, db, steps)
+	case "status":
+		status, err := dbstorage.Status(ctx, db)
+		if err != nil {
+			log.Println(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return w.Flush()
+	default:
+		return errors.New(migrateUsage)
+	}
+}
@@ -0,0 +1,302 @@
+package alerting
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+)
+
+type State string
+
+const (
+	StateInactive State = "inactive"
+	StatePending  State = "pending"
+	StateFiring   State = "firing"
+	StateResolved State = "resolved"
+)
+
+const (
+	// notifyTimeout bounds a single notification, so a hanging webhook can't hold up the queue.
+	notifyTimeout = 10 * time.Second
+	// notifyQueue is how many firing and resolved alerts may wait for delivery.
+	notifyQueue = 256
+)
+
+// Alert is the current state of a rule.
+type Alert struct {
+	Rule        string     `json:"rule"`
+	Metric      string     `json:"metric"`
+	Type        string     `json:"type"`
+	Op          string     `json:"op"`
+	Threshold   float64    `json:"threshold"`
+	Severity    string     `json:"severity,omitempty"`
+	Description string     `json:"description,omitempty"`
+	State       State      `json:"state"`
+	Value       *float64   `json:"value,omitempty"`
+	ActiveSince *time.Time `json:"activeSince,omitempty"`
+	FiredAt     *time.Time `json:"firedAt,omitempty"`
+	ResolvedAt  *time.Time `json:"resolvedAt,omitempty"`
+}
+
+type alertState struct {
+	Alert
+	rule         Rule
+	observed     bool
+	last         float64
+	lastIncrease time.Time
+}
+
+// Engine evaluates rules against metrics as the Storager accepts them and, every
+// Interval, against the stored values, so conditions held for a duration fire
+// even when no new updates arrive. Firing and resolved alerts are queued and sent to
+// the Notifiers in order by Run, so slow notifiers don't hold up evaluation.
+type Engine struct {
+	Storager  *repositories.Storager
+	Interval  time.Duration
+	Notifiers []Notifier
+	Mutex     *sync.RWMutex
+	alerts    []*alertState
+	byMetric  map[string][]*alertState
+	outbox    chan Alert
+	now       func() time.Time
+}
+
+func New(rules []Rule, s *repositories.Storager, interval time.Duration, notifiers ...Notifier) (*Engine, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("alert evaluation interval must be positive, got %v", interval)
+	}
+
+	e := &Engine{
+		Storager:  s,
+		Interval:  interval,
+		Notifiers: notifiers,
+		Mutex:     &sync.RWMutex{},
+		byMetric:  make(map[string][]*alertState),
+		outbox:    make(chan Alert, notifyQueue),
+		now:       time.Now,
+	}
+
+	seen := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("%w: %s is duplicated", ErrInvalidRule, r.Name)
+		}
+		seen[r.Name] = true
+
+		a := &alertState{
+			Alert: Alert{
+				Rule:        r.Name,
+				Metric:      r.Metric,
+				Type:        r.Type,
+				Op:          r.Op,
+				Threshold:   r.Threshold,
+				Severity:    r.Severity,
+				Description: r.Description,
+				State:       StateInactive,
+			},
+			rule: r,
+		}
+		e.alerts = append(e.alerts, a)
+		key := r.Type + ":" + r.Metric
+		e.byMetric[key] = append(e.byMetric[key], a)
+	}
+
+	return e, nil
+}
+
+// Run evaluates incoming updates and stored values and delivers notifications
+// until ctx is cancelled.
+func (e *Engine) Run(ctx context.Context) {
+	delivered := make(chan struct{})
+	go func() {
+		defer close(delivered)
+		e.deliver(ctx)
+	}()
+	defer func() { <-delivered }()
+
+	var (
+		sub     *repositories.Subscription
+		updates <-chan repositories.Metrics
+		dropped uint64
+	)
+	if e.Storager.Broker != nil {
+		sub = e.Storager.Broker.Subscribe(repositories.Filter{}, 1024)
+		defer sub.Close()
+		updates = sub.C
+	}
+
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+
+	e.Evaluate(ctx)
+	for {
+		select {
+		case m, ok := <-updates:
+			if !ok {
+				updates = nil
+				continue
+			}
+			e.Observe(ctx, m)
+		case <-ticker.C:
+			// Rules on the dropped updates still see the stored values below.
+			if sub != nil && sub.Dropped() > dropped {
+				log.Printf("Alerting engine fell behind and skipped %d updates", sub.Dropped()-dropped)
+				dropped = sub.Dropped()
+			}
+			e.Evaluate(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Observe evaluates the rules on the metric m.
+func (e *Engine) Observe(ctx context.Context, m repositories.Metrics) {
+	var v float64
+	switch {
+	case m.MType == "gauge" && m.Value != nil:
+		v = *m.Value
+	case m.MType == "counter" && m.Delta != nil:
+		v = float64(*m.Delta)
+	default:
+		return
+	}
+
+	e.Mutex.Lock()
+	var changed []Alert
+	now := e.now()
+	for _, a := range e.byMetric[m.MType+":"+m.ID] {
+		if a.observe(v, now) {
+			changed = append(changed, a.Alert)
+		}
+	}
+	e.Mutex.Unlock()
+
+	e.notify(changed)
+}
+
+// Evaluate checks every rule against the stored value of its metric.
+// Metrics that were never received are skipped.
+func (e *Engine) Evaluate(ctx context.Context) {
+	for _, a := range e.alerts {
+		m, err := e.Storager.GetMetric(ctx, repositories.Metrics{ID: a.rule.Metric, MType: a.rule.Type})
+		if err == repositories.ErrMetricNotFound {
+			continue
+		}
+		if err != nil {
+			log.Printf("Unable to evaluate alert rule %s. Error: %v", a.rule.Name, err)
+			continue
+		}
+		e.Observe(ctx, m)
+	}
+}
+
+// Alerts returns the state of every rule ordered by rule name.
+func (e *Engine) Alerts() []Alert {
+	e.Mutex.RLock()
+	defer e.Mutex.RUnlock()
+
+	res := make([]Alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		res = append(res, a.Alert)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Rule < res[j].Rule })
+
+	return res
+}
+
+// notify queues alerts for delivery. When the queue is full the alert is dropped;
+// its state is still reported by Alerts.
+func (e *Engine) notify(alerts []Alert) {
+	for _, a := range alerts {
+		select {
+		case e.outbox <- a:
+		default:
+			log.Printf("Notification queue is full, dropping %s notification for alert %s", a.State, a.Rule)
+		}
+	}
+}
+
+// deliver sends queued alerts to the Notifiers until ctx is cancelled.
+func (e *Engine) deliver(ctx context.Context) {
+	for {
+		select {
+		case a := <-e.outbox:
+			e.send(ctx, a)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (e *Engine) send(ctx context.Context, a Alert) {
+	for _, n := range e.Notifiers {
+		nctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		if err := n.Notify(nctx, a); err != nil {
+			log.Printf("Unable to send notification for alert %s. Error: %v", a.Rule, err)
+		}
+		cancel()
+	}
+}
+
+// observe moves the alert through inactive -> pending -> firing -> resolved and
+// reports whether it started firing or got resolved.
+func (a *alertState) observe(v float64, now time.Time) bool {
+	value := v
+	a.Value = &value
+
+	var (
+		holds bool
+		since = now
+	)
+	if a.rule.Op == OpStalled {
+		if !a.observed || v > a.last {
+			a.lastIncrease = now
+		}
+		holds = a.observed && v <= a.last
+		since = a.lastIncrease
+	} else {
+		holds = a.rule.holds(v)
+	}
+	a.observed, a.last = true, v
+
+	if !holds {
+		switch a.State {
+		case StatePending:
+			a.State, a.ActiveSince = StateInactive, nil
+		case StateFiring:
+			a.State, a.ResolvedAt = StateResolved, &now
+			return true
+		}
+		return false
+	}
+
+	if a.State != StatePending && a.State != StateFiring {
+		a.State, a.ActiveSince, a.FiredAt, a.ResolvedAt = StatePending, &since, nil, nil
+	}
+	if a.State == StatePending && now.Sub(*a.ActiveSince) >= a.rule.duration {
+		a.State, a.FiredAt = StateFiring, &now
+		return true
+	}
+	return false
+}
+
+func (a Alert) String() string {
+	value := "n/a"
+	if a.Value != nil {
+		value = strconv.FormatFloat(*a.Value, 'g', -1, 64)
+	}
+	if a.Op == OpStalled {
+		return fmt.Sprintf("[%s] %s: %s %s stalled at %s", a.State, a.Rule, a.Type, a.Metric, value)
+	}
+	return fmt.Sprintf("[%s] %s: %s %s = %s (%s %v)", a.State, a.Rule, a.Type, a.Metric, value, a.Op, a.Threshold)
+}
@@ -0,0 +1,232 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+	"github.com/fkocharli/metricity/internal/storage/memorystorage"
+	"github.com/fkocharli/metricity/internal/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recorder struct {
+	Mutex  *sync.Mutex
+	alerts []Alert
+}
+
+func (r *recorder) Notify(_ context.Context, a Alert) error {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	r.alerts = append(r.alerts, a)
+	return nil
+}
+
+func (r *recorder) states() []State {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	var res []State
+	for _, a := range r.alerts {
+		res = append(res, a.State)
+	}
+	return res
+}
+
+// delivered sends the queued notifications, as Run does, and returns the states
+// the recorder got.
+func delivered(e *Engine, rec *recorder) []State {
+	for {
+		select {
+		case a := <-e.outbox:
+			e.send(context.Background(), a)
+		default:
+			return rec.states()
+		}
+	}
+}
+
+func newEngine(t *testing.T, rules ...Rule) (*Engine, *recorder, *time.Time) {
+	storager := repositories.NewStorager(memorystorage.NewRepository(), nil, "")
+	rec := &recorder{Mutex: &sync.Mutex{}}
+	e, err := New(rules, &storager, time.Minute, rec)
+	require.NoError(t, err)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	e.now = func() time.Time { return now }
+	return e, rec, &now
+}
+
+func TestThresholdRule(t *testing.T) {
+	ctx := context.Background()
+	e, rec, now := newEngine(t, Rule{Name: "high-alloc", Metric: "Alloc", Type: "gauge", Op: OpGreater, Threshold: 100, For: "1m"})
+
+	e.Observe(ctx, testutil.Gauge("Alloc", 50))
+	assert.Equal(t, StateInactive, e.Alerts()[0].State)
+
+	e.Observe(ctx, testutil.Gauge("Alloc", 150))
+	assert.Equal(t, StatePending, e.Alerts()[0].State)
+
+	// Dropping below the threshold before For elapses cancels the alert.
+	*now = now.Add(30 * time.Second)
+	e.Observe(ctx, testutil.Gauge("Alloc", 90))
+	assert.Equal(t, StateInactive, e.Alerts()[0].State)
+	assert.Empty(t, delivered(e, rec))
+
+	e.Observe(ctx, testutil.Gauge("Alloc", 150))
+	*now = now.Add(time.Minute)
+	e.Observe(ctx, testutil.Gauge("Alloc", 200))
+	a := e.Alerts()[0]
+	assert.Equal(t, StateFiring, a.State)
+	assert.Equal(t, 200.0, *a.Value)
+	assert.Equal(t, *now, *a.FiredAt)
+
+	// Other metrics and types don't affect the rule.
+	e.Observe(ctx, testutil.Gauge("Other", 0))
+	e.Observe(ctx, testutil.Counter("Alloc", 0))
+	assert.Equal(t, StateFiring, e.Alerts()[0].State)
+
+	*now = now.Add(time.Minute)
+	e.Observe(ctx, testutil.Gauge("Alloc", 10))
+	a = e.Alerts()[0]
+	assert.Equal(t, StateResolved, a.State)
+	assert.Equal(t, *now, *a.ResolvedAt)
+
+	assert.Equal(t, []State{StateFiring, StateResolved}, delivered(e, rec))
+}
+
+func TestStalledRule(t *testing.T) {
+	ctx := context.Background()
+	e, rec, now := newEngine(t, Rule{Name: "agent-down", Metric: "PollCount", Type: "counter", Op: OpStalled, For: "1m"})
+
+	// Nothing stored yet: nothing to evaluate.
+	e.Evaluate(ctx)
+	assert.Equal(t, StateInactive, e.Alerts()[0].State)
+
+	_, err := e.Storager.UpdateMetrics(ctx, testutil.Counter("PollCount", 5))
+	require.NoError(t, err)
+	e.Evaluate(ctx)
+	assert.Equal(t, StateInactive, e.Alerts()[0].State)
+
+	*now = now.Add(30 * time.Second)
+	e.Evaluate(ctx)
+	assert.Equal(t, StatePending, e.Alerts()[0].State)
+
+	*now = now.Add(30 * time.Second)
+	e.Evaluate(ctx)
+	assert.Equal(t, StateFiring, e.Alerts()[0].State)
+
+	_, err = e.Storager.UpdateMetrics(ctx, testutil.Counter("PollCount", 1))
+	require.NoError(t, err)
+	e.Evaluate(ctx)
+	assert.Equal(t, StateResolved, e.Alerts()[0].State)
+	assert.Equal(t, 6.0, *e.Alerts()[0].Value)
+
+	assert.Equal(t, []State{StateFiring, StateResolved}, delivered(e, rec))
+}
+
+func TestRunObservesUpdates(t *testing.T) {
+	storager := repositories.NewStorager(memorystorage.NewRepository(), nil, "")
+	storager.Broker = repositories.NewBroker()
+	rec := &recorder{Mutex: &sync.Mutex{}}
+	e, err := New([]Rule{{Name: "low-memory", Metric: "FreeMemory", Type: "gauge", Op: OpLess, Threshold: 1024}}, &storager, time.Hour, rec)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.Run(ctx)
+	}()
+
+	require.Eventually(t, storager.Broker.HasSubscribers, time.Second, 10*time.Millisecond)
+	_, err = storager.UpdateMetrics(ctx, testutil.Gauge("FreeMemory", 10))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return len(rec.states()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, StateFiring, e.Alerts()[0].State)
+
+	cancel()
+	<-done
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got Alert
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	v := 150.0
+	n := NewWebhookNotifier(srv.URL)
+	require.NoError(t, n.Notify(context.Background(), Alert{Rule: "high-alloc", Metric: "Alloc", Type: "gauge", State: StateFiring, Value: &v}))
+	assert.Equal(t, "high-alloc", got.Rule)
+	assert.Equal(t, StateFiring, got.State)
+	assert.Equal(t, 150.0, *got.Value)
+
+	status = http.StatusBadGateway
+	assert.Error(t, n.Notify(context.Background(), Alert{Rule: "high-alloc"}))
+}
+
+func TestLoadRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+- name: high-alloc
+  metric: Alloc
+  type: gauge
+  op: ">"
+  threshold: 1e9
+  for: 5m
+  severity: warning
+- name: agent-down
+  metric: PollCount
+  type: counter
+  op: stalled
+  for: 1m
+`), 0644))
+
+	rules, err := LoadRules(path)
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, "warning", rules[0].Severity)
+
+	e, err := New(rules, nil, time.Minute)
+	require.NoError(t, err)
+	alerts := e.Alerts()
+	assert.Equal(t, "agent-down", alerts[0].Rule)
+	assert.Equal(t, "high-alloc", alerts[1].Rule)
+
+	invalid := []Rule{
+		{Metric: "Alloc", Type: "gauge", Op: OpGreater},
+		{Name: "r", Type: "gauge", Op: OpGreater},
+		{Name: "r", Metric: "Alloc", Type: "histogram", Op: OpGreater},
+		{Name: "r", Metric: "Alloc", Type: "gauge", Op: "~"},
+		{Name: "r", Metric: "Alloc", Type: "gauge", Op: OpStalled},
+		{Name: "r", Metric: "Alloc", Type: "gauge", Op: OpGreater, For: "soon"},
+	}
+	for _, r := range invalid {
+		_, err := New([]Rule{r}, nil, time.Minute)
+		assert.True(t, errors.Is(err, ErrInvalidRule), "%+v", r)
+	}
+
+	_, err = New([]Rule{rules[0], rules[0]}, nil, time.Minute)
+	assert.True(t, errors.Is(err, ErrInvalidRule))
+
+	_, err = New(rules, nil, 0)
+	assert.Error(t, err)
+}
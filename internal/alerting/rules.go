@@ -0,0 +1,112 @@
+package alerting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Conditions a rule can check. OpStalled fires when the metric doesn't increase
+// for the rule's For duration, e.g. an agent that stopped reporting PollCount.
+const (
+	OpGreater      = ">"
+	OpGreaterEqual = ">="
+	OpLess         = "<"
+	OpLessEqual    = "<="
+	OpEqual        = "=="
+	OpNotEqual     = "!="
+	OpStalled      = "stalled"
+)
+
+var ErrInvalidRule = errors.New("invalid alert rule")
+
+// Rule raises an alert when Metric satisfies Op against Threshold for at least For.
+type Rule struct {
+	Name        string  `json:"name" yaml:"name"`
+	Metric      string  `json:"metric" yaml:"metric"`
+	Type        string  `json:"type" yaml:"type"`
+	Op          string  `json:"op" yaml:"op"`
+	Threshold   float64 `json:"threshold,omitempty" yaml:"threshold,omitempty"`
+	For         string  `json:"for,omitempty" yaml:"for,omitempty"`
+	Severity    string  `json:"severity,omitempty" yaml:"severity,omitempty"`
+	Description string  `json:"description,omitempty" yaml:"description,omitempty"`
+
+	duration time.Duration
+}
+
+// LoadRules reads a list of rules from a YAML (.yaml, .yml) or JSON file.
+func LoadRules(path string) ([]Rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []Rule
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		err = yaml.Unmarshal(b, &rules)
+	} else {
+		err = json.Unmarshal(b, &rules)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse alert rules %s: %v", path, err)
+	}
+
+	return rules, nil
+}
+
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("%w: no name", ErrInvalidRule)
+	}
+	if r.Metric == "" {
+		return fmt.Errorf("%w: %s has no metric", ErrInvalidRule, r.Name)
+	}
+	if r.Type != "gauge" && r.Type != "counter" {
+		return fmt.Errorf("%w: %s has unknown type %q", ErrInvalidRule, r.Name, r.Type)
+	}
+
+	switch r.Op {
+	case OpGreater, OpGreaterEqual, OpLess, OpLessEqual, OpEqual, OpNotEqual:
+	case OpStalled:
+		if r.For == "" {
+			return fmt.Errorf("%w: %s needs a duration to detect a stall", ErrInvalidRule, r.Name)
+		}
+	default:
+		return fmt.Errorf("%w: %s has unknown op %q", ErrInvalidRule, r.Name, r.Op)
+	}
+
+	if r.For != "" {
+		d, err := time.ParseDuration(r.For)
+		if err != nil || d < 0 {
+			return fmt.Errorf("%w: %s has invalid duration %q", ErrInvalidRule, r.Name, r.For)
+		}
+		r.duration = d
+	}
+
+	return nil
+}
+
+func (r *Rule) holds(v float64) bool {
+	switch r.Op {
+	case OpGreater:
+		return v > r.Threshold
+	case OpGreaterEqual:
+		return v >= r.Threshold
+	case OpLess:
+		return v < r.Threshold
+	case OpLessEqual:
+		return v <= r.Threshold
+	case OpEqual:
+		return v == r.Threshold
+	case OpNotEqual:
+		return v != r.Threshold
+	}
+	return false
+}
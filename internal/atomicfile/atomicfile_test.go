@@ -0,0 +1,43 @@
+package atomicfile
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "subscriptions.json")
+
+	require.NoError(t, WriteBytes(path, []byte("old")))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(b))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// A failed write or hook leaves the old content and no temporary file behind.
+	failed := errors.New("disk full")
+	assert.ErrorIs(t, Write(path, func(w io.Writer) error { return failed }, nil), failed)
+	assert.ErrorIs(t, WriteBytes(filepath.Join(dir, "missing", "file"), nil), os.ErrNotExist)
+	assert.ErrorIs(t, Write(path, func(w io.Writer) error {
+		_, err := w.Write([]byte("new"))
+		return err
+	}, func() error { return failed }), failed)
+
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(b))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -22,15 +22,46 @@ type AgentConfig struct {
 	ReportInterval time.Duration `env:"REPORT_INTERVAL" envDefault:"10s"`
 	PollInterval   time.Duration `env:"POLL_INTERVAL" envDefault:"2s"`
 	Key            string        `enc:"KEY" envDefault:""`
+	ID             string        `env:"AGENT_ID" envDefault:""`
 }
 
 type ServerConfig struct {
-	Address       string        `env:"ADDRESS" envDefault:"127.0.0.1:8080"`
-	StoreInterval time.Duration `env:"STORE_INTERVAL" envDefault:"300s"`
-	StoreFile     string        `env:"STORE_FILE" envDefault:"/tmp/devops-metrics-db.json"`
-	Restore       bool          `env:"RESTORE" envDefault:"true"`
-	Key           string        `enc:"KEY" envDefault:""`
-	DBDSN         string        `env:"DATABASE_DSN"`
+	Address            string        `env:"ADDRESS" envDefault:"127.0.0.1:8080"`
+	StoreInterval      time.Duration `env:"STORE_INTERVAL" envDefault:"300s"`
+	StoreFile          string        `env:"STORE_FILE" envDefault:"/tmp/devops-metrics-db.json"`
+	StoreKeep          int           `env:"STORE_KEEP" envDefault:"3"`
+	StoreFormat        string        `env:"STORE_FORMAT" envDefault:"json"`
+	CompactInterval    time.Duration `env:"COMPACT_INTERVAL" envDefault:"300s"`
+	Restore            bool          `env:"RESTORE" envDefault:"true"`
+	MemoryShards       int           `env:"MEMORY_SHARDS" envDefault:"0"`
+	Key                string        `enc:"KEY" envDefault:""`
+	DBDSN              string        `env:"DATABASE_DSN"`
+	DBCache            bool          `env:"DATABASE_CACHE" envDefault:"false"`
+	DBSeed             bool          `env:"DATABASE_SEED" envDefault:"false"`
+	DBFlushInterval    time.Duration `env:"DATABASE_FLUSH_INTERVAL" envDefault:"1s"`
+	DBQueryTimeout     time.Duration `env:"DATABASE_QUERY_TIMEOUT" envDefault:"5s"`
+	MaxBodySize        int64         `env:"MAX_BODY_SIZE" envDefault:"1048576"`
+	MaxBatchSize       int           `env:"MAX_BATCH_SIZE" envDefault:"1000"`
+	RateLimit          float64       `env:"RATE_LIMIT" envDefault:"0"`
+	RateBurst          int           `env:"RATE_BURST" envDefault:"0"`
+	TrustedProxies     []string      `env:"TRUSTED_PROXIES" envSeparator:","`
+	RegistryFile       string        `env:"METRIC_REGISTRY"`
+	RegistryStrict     bool          `env:"METRIC_REGISTRY_STRICT" envDefault:"false"`
+	HistorySize        int           `env:"HISTORY_SIZE" envDefault:"60"`
+	HistoryInterval    time.Duration `env:"HISTORY_INTERVAL" envDefault:"10s"`
+	DashboardRefresh   time.Duration `env:"DASHBOARD_REFRESH" envDefault:"10s"`
+	TemplateDir        string        `env:"TEMPLATE_DIR"`
+	AlertRules         string        `env:"ALERT_RULES"`
+	AlertInterval      time.Duration `env:"ALERT_INTERVAL" envDefault:"30s"`
+	AlertWebhook       string        `env:"ALERT_WEBHOOK"`
+	WebhooksFile       string        `env:"WEBHOOKS_FILE"`
+	WebhookRetries     int           `env:"WEBHOOK_RETRIES" envDefault:"3"`
+	WebhookBackoff     time.Duration `env:"WEBHOOK_BACKOFF" envDefault:"1s"`
+	WebhookDeadLetters string        `env:"WEBHOOK_DEAD_LETTERS"`
+	ForwardTo          []string      `env:"FORWARD_TO" envSeparator:","`
+	ForwardKey         string        `env:"FORWARD_KEY"`
+	ForwardInterval    time.Duration `env:"FORWARD_INTERVAL" envDefault:"1s"`
+	ForwardBatchSize   int           `env:"FORWARD_BATCH_SIZE" envDefault:"1000"`
 }
 
 func NewConfig(t string) (*Config, error) {
@@ -64,6 +95,11 @@ func NewConfig(t string) (*Config, error) {
 		if !isEnvExist("POLL_INTERVAL") && poll != 0 {
 			cfg.AgentConfig.PollInterval = poll
 		}
+		if cfg.AgentConfig.ID == "" {
+			if h, err := os.Hostname(); err == nil {
+				cfg.AgentConfig.ID = h
+			}
+		}
 		log.Printf("Starting agent with following configs: %+v", cfg.AgentConfig)
 
 	case "server":
@@ -80,7 +116,7 @@ func NewConfig(t string) (*Config, error) {
 		flag.BoolVar(&restore, "r", true, "Please provide server Address in form 'true/false'")
 		flag.StringVar(&file, "f", "/tmp/devops-metrics-db.json", "Please provide server Address in form '/path/to/file.json'")
 		flag.StringVar(&key, "k", "", "Please provide Key for sign")
-		flag.StringVar(&db, "d", "", "Please provide DB DSN")
+		flag.StringVar(&db, "d", "", "Please provide DB DSN: Postgres, sqlite:///path/to/metrics.db or bolt:///path/to/metrics.bolt")
 
 		flag.Parse()
 
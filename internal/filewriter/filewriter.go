@@ -2,45 +2,63 @@ package filewriter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/fkocharli/metricity/internal/repositories"
 )
 
+// Filer writes snapshots of Repo to FileRepo every StoreInterval. With a StoreInterval
+// of 0 updates go to the write-ahead log as they happen and the snapshot compacts the
+// log every CompactInterval instead. A CompactInterval of 0 compacts it only on
+// startup after a restore and on shutdown, so the log grows for as long as the server runs.
 type Filer struct {
-	FileRepo      repositories.FileRepository
-	Repo          repositories.Storage
-	StoreInterval time.Duration
-	Restore       bool
+	FileRepo        repositories.FileRepository
+	Repo            repositories.Storage
+	StoreInterval   time.Duration
+	CompactInterval time.Duration
+	Restore         bool
 }
 
-func New(fr repositories.FileRepository, r repositories.Storage, st time.Duration, res bool) *Filer {
-	return &Filer{
-		FileRepo:      fr,
-		Repo:          r,
-		StoreInterval: st,
-		Restore:       res,
+func New(fr repositories.FileRepository, r repositories.Storage, st, ct time.Duration, res bool) (*Filer, error) {
+	if st < 0 {
+		return nil, fmt.Errorf("store interval must not be negative, got %v", st)
+	}
+	if ct < 0 {
+		return nil, fmt.Errorf("compact interval must not be negative, got %v", ct)
 	}
+
+	return &Filer{
+		FileRepo:        fr,
+		Repo:            r,
+		StoreInterval:   st,
+		CompactInterval: ct,
+		Restore:         res,
+	}, nil
 }
 
 func (f *Filer) Run(ctx context.Context) error {
 	if f.Restore {
 		log.Println("Restoring from file")
-		f.Load()
+		f.Load(ctx)
+		if err := f.Save(ctx); err != nil {
+			log.Printf("Unable to compact restored metrics. Error: %v", err)
+		}
 	}
 	var err error
 	group := &sync.WaitGroup{}
 
 	errChan := make(chan error, 1)
 
-	if f.StoreInterval != 0 {
+	if interval := f.saveInterval(); interval != 0 {
 		group.Add(1)
 		go func() {
 			defer group.Done()
-			f.SaveOnTick(ctx)
+			f.SaveOnTick(ctx, interval)
 		}()
 	}
 
@@ -50,7 +68,10 @@ func (f *Filer) Run(ctx context.Context) error {
 		log.Println("Starting Saving to disk")
 		go func() {
 			defer group.Done()
-			err := f.Save()
+			saveCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			defer cancel()
+
+			err := f.Save(saveCtx)
 			if err != nil {
 				log.Println(err)
 			}
@@ -62,15 +83,30 @@ func (f *Filer) Run(ctx context.Context) error {
 	return err
 }
 
-func (f *Filer) Save() error {
-	log.Println("Saving to disk")
+// saveInterval returns how often the snapshot is written. In sync mode updates
+// already go to the write-ahead log, so the snapshot only compacts it.
+func (f *Filer) saveInterval() time.Duration {
+	if f.FileRepo.Sync() {
+		return f.CompactInterval
+	}
+	return f.StoreInterval
+}
 
-	var metrics []repositories.Metrics
+func (f *Filer) Save(ctx context.Context) error {
+	log.Println("Saving to disk")
 
-	metrics = append(metrics, f.Repo.GetAllCounterMetrics()...)
-	metrics = append(metrics, f.Repo.GetAllGaugeMetrics()...)
+	err := f.FileRepo.SaveAllToDisk(func() ([]repositories.Metrics, error) {
+		counters, err := f.Repo.GetAllCounterMetrics(ctx)
+		if err != nil {
+			return nil, err
+		}
+		gauges, err := f.Repo.GetAllGaugeMetrics(ctx)
+		if err != nil {
+			return nil, err
+		}
 
-	err := f.FileRepo.SaveAllToDisk(metrics)
+		return append(counters, gauges...), nil
+	})
 	if err != nil {
 		return err
 	}
@@ -78,51 +114,103 @@ func (f *Filer) Save() error {
 
 }
 
-func (f *Filer) SaveOnTick(ctx context.Context) {
+func (f *Filer) SaveOnTick(ctx context.Context, interval time.Duration) {
 
-	storageTimer := time.NewTicker(f.StoreInterval)
+	storageTimer := time.NewTicker(interval)
 	defer storageTimer.Stop()
 
-	var errChan chan error
 	for {
 		select {
 		case <-storageTimer.C:
-			err := f.Save()
+			err := f.Save(ctx)
 			if err != nil {
-				errChan <- err
+				log.Println(err)
 			}
 		case <-ctx.Done():
 			return
-		case err := <-errChan:
-			log.Println(err)
 		}
 	}
 }
 
-func (f *Filer) Load() {
-
-	var metrics []repositories.Metrics
-
-	metrics, err := f.FileRepo.LoadFromDisk()
-	if err != nil {
-		log.Println(err)
-	}
-
-	for _, v := range metrics {
+// Load restores the snapshot and replays the write-ahead log on top of it into the
+// storage the server starts with. Both hold resulting metric values, so the last recorded
+// value of every metric wins. Metrics that can't be read back are skipped, never added twice.
+func (f *Filer) Load(ctx context.Context) {
+	for _, v := range restored(f.FileRepo) {
 		switch v.MType {
 		case "counter":
-			_, err := f.Repo.UpdateCounterMetrics(v.ID, fmt.Sprintf("%v", *v.Delta))
+			delta := *v.Delta
+			stored, err := f.Repo.GetCounterMetrics(ctx, v.ID)
+			switch {
+			case err == nil:
+				current, err := strconv.ParseInt(stored, 10, 64)
+				if err != nil {
+					log.Printf("Unable to load counter metric: \n %v \n Error: %v", v, err)
+					continue
+				}
+				if current == delta {
+					continue
+				}
+				delta -= current
+			case !errors.Is(err, repositories.ErrMetricNotFound):
+				log.Printf("Unable to load counter metric: \n %v \n Error: %v", v, err)
+				continue
+			}
+			_, err = f.Repo.UpdateCounterMetrics(ctx, v.ID, fmt.Sprintf("%v", delta))
 			if err != nil {
 				log.Printf("Unable to load counter metric: \n %v \n Error: %v", v, err)
 			}
 		case "gauge":
-			err := f.Repo.UpdateGaugeMetrics(v.ID, fmt.Sprintf("%v", *v.Value))
+			err := f.Repo.UpdateGaugeMetrics(ctx, v.ID, fmt.Sprintf("%v", *v.Value))
 			if err != nil {
 				log.Printf("Unable to load gauge metric: \n %v \n Error: %v", v, err)
 			}
 		}
 	}
+}
+
+// Seed writes the metrics of the snapshot and the write-ahead log that the storage
+// doesn't have yet, e.g. into a fresh database. Stored metrics are left alone, so
+// neither increments written after the snapshot nor other replicas are rewound.
+func Seed(ctx context.Context, fr repositories.FileRepository, s repositories.Storage) error {
+	seeder, ok := s.(repositories.Seeder)
+	if !ok {
+		return errors.New("storage can't be seeded")
+	}
+
+	metrics := restored(fr)
+	if len(metrics) == 0 {
+		return nil
+	}
+	log.Printf("Seeding storage with %d metrics from file", len(metrics))
+	return seeder.SeedMetrics(ctx, metrics)
+}
+
+// restored returns the latest value of every metric in the snapshot and the write-ahead log.
+func restored(fr repositories.FileRepository) []repositories.Metrics {
+	metrics, err := fr.LoadFromDisk()
+	if err != nil {
+		log.Println(err)
+	}
 
-	time.Sleep(10 * time.Second)
+	logged, err := fr.LoadLog()
+	if err != nil {
+		log.Println(err)
+	}
 
+	latest := make(map[string]int, len(metrics))
+	res := make([]repositories.Metrics, 0, len(metrics))
+	for _, v := range append(metrics, logged...) {
+		if (v.MType == "counter" && v.Delta == nil) || (v.MType == "gauge" && v.Value == nil) {
+			continue
+		}
+		key := v.MType + ":" + v.ID
+		if i, ok := latest[key]; ok {
+			res[i] = v
+			continue
+		}
+		latest[key] = len(res)
+		res = append(res, v)
+	}
+	return res
 }
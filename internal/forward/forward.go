@@ -0,0 +1,239 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+)
+
+const (
+	requestTimeout  = 10 * time.Second
+	shutdownTimeout = 5 * time.Second
+	maxBackoff      = time.Minute
+)
+
+// Upstream forwards accepted updates to another metricity server through its
+// /updates/ endpoint. Updates are merged while they wait: gauges keep the latest
+// value and counter increments add up, so the buffer never grows beyond the
+// number of distinct metrics and nothing is lost while the upstream is down.
+// Failed sends are retried every Interval with exponential backoff.
+//
+// Delivery is at-least-once: when a request fails after the upstream applied it,
+// e.g. the response times out or a proxy answers 502, the batch is sent again
+// and its counter increments are counted twice. Gauges are unaffected.
+type Upstream struct {
+	URL       string
+	Key       string
+	Interval  time.Duration
+	BatchSize int
+	Client    *http.Client
+	Mutex     *sync.Mutex
+	pending   map[string]repositories.Metrics
+}
+
+// New creates a forwarder to the server at address, given either as a URL or as host:port.
+func New(address, key string, interval time.Duration, batchSize int) (*Upstream, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("forward interval must be positive, got %v", interval)
+	}
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	return &Upstream{
+		URL:       strings.TrimSuffix(address, "/"),
+		Key:       key,
+		Interval:  interval,
+		BatchSize: batchSize,
+		Client:    &http.Client{Timeout: requestTimeout},
+		Mutex:     &sync.Mutex{},
+		pending:   make(map[string]repositories.Metrics),
+	}, nil
+}
+
+// Forward buffers the metrics until the next send.
+func (u *Upstream) Forward(metrics ...repositories.Metrics) {
+	u.Mutex.Lock()
+	defer u.Mutex.Unlock()
+
+	for _, m := range metrics {
+		u.merge(m, true)
+	}
+}
+
+// Pending is the number of metrics waiting to be sent.
+func (u *Upstream) Pending() int {
+	u.Mutex.Lock()
+	defer u.Mutex.Unlock()
+
+	return len(u.pending)
+}
+
+// Run sends the buffered metrics every Interval until ctx is cancelled, then makes a last attempt.
+func (u *Upstream) Run(ctx context.Context) {
+	ticker := time.NewTicker(u.Interval)
+	defer ticker.Stop()
+
+	var (
+		backoff time.Duration
+		retryAt time.Time
+	)
+	for {
+		select {
+		case <-ticker.C:
+			if time.Now().Before(retryAt) {
+				continue
+			}
+			if err := u.Flush(ctx); err != nil {
+				backoff = nextBackoff(backoff, u.Interval)
+				retryAt = time.Now().Add(backoff)
+				log.Printf("Unable to forward metrics to %s, retrying in %v. Error: %v", u.URL, backoff, err)
+				continue
+			}
+			backoff = 0
+		case <-ctx.Done():
+			fctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if err := u.Flush(fctx); err != nil {
+				log.Printf("Unable to forward %d metrics to %s on shutdown. Error: %v", u.Pending(), u.URL, err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// Flush sends the buffered metrics in batches of BatchSize. Batches that fail
+// with a retryable error are put back in the buffer, whether or not the upstream
+// got to apply them; batches the upstream refuses for good are dropped and logged.
+func (u *Upstream) Flush(ctx context.Context) error {
+	u.Mutex.Lock()
+	metrics := make([]repositories.Metrics, 0, len(u.pending))
+	for _, m := range u.pending {
+		metrics = append(metrics, m)
+	}
+	u.pending = make(map[string]repositories.Metrics)
+	u.Mutex.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].MType != metrics[j].MType {
+			return metrics[i].MType > metrics[j].MType
+		}
+		return metrics[i].ID < metrics[j].ID
+	})
+
+	size := u.BatchSize
+	if size <= 0 {
+		size = len(metrics)
+	}
+	for start := 0; start < len(metrics); start += size {
+		end := start + size
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+
+		retry, err := u.send(ctx, metrics[start:end])
+		if err == nil {
+			continue
+		}
+		if !retry {
+			log.Printf("Upstream %s refused %d metrics, dropping them. Error: %v", u.URL, end-start, err)
+			continue
+		}
+
+		u.requeue(metrics[start:])
+		return err
+	}
+
+	return nil
+}
+
+func (u *Upstream) send(ctx context.Context, metrics []repositories.Metrics) (bool, error) {
+	if u.Key != "" {
+		for i := range metrics {
+			metrics[i].Hash = repositories.Sign(metrics[i], u.Key)
+		}
+	}
+
+	b, err := json.Marshal(metrics)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.URL+"/updates/?mode="+string(repositories.BatchBestEffort), bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := u.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		var res repositories.BatchResult
+		if err := json.NewDecoder(resp.Body).Decode(&res); err == nil && len(res.Rejected) > 0 {
+			log.Printf("Upstream %s rejected %d of %d metrics: %v", u.URL, len(res.Rejected), len(metrics), res.Rejected)
+		}
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		io.Copy(io.Discard, resp.Body)
+		return true, fmt.Errorf("upstream responded with %s", resp.Status)
+	default:
+		io.Copy(io.Discard, resp.Body)
+		return false, fmt.Errorf("upstream responded with %s", resp.Status)
+	}
+}
+
+// requeue puts unsent metrics back. Gauges buffered since are newer and win,
+// counter increments are added to the ones buffered since.
+func (u *Upstream) requeue(metrics []repositories.Metrics) {
+	u.Mutex.Lock()
+	defer u.Mutex.Unlock()
+
+	for _, m := range metrics {
+		u.merge(m, false)
+	}
+}
+
+func (u *Upstream) merge(m repositories.Metrics, replaceGauge bool) {
+	key := m.MType + ":" + m.ID
+	old, ok := u.pending[key]
+
+	switch m.MType {
+	case "gauge":
+		if ok && !replaceGauge {
+			return
+		}
+		v := *m.Value
+		u.pending[key] = repositories.Metrics{ID: m.ID, MType: m.MType, Value: &v}
+	case "counter":
+		d := *m.Delta
+		if ok {
+			d += *old.Delta
+		}
+		u.pending[key] = repositories.Metrics{ID: m.ID, MType: m.MType, Delta: &d}
+	}
+}
+
+func nextBackoff(d, min time.Duration) time.Duration {
+	if d < min {
+		return min
+	}
+	if d *= 2; d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
@@ -0,0 +1,148 @@
+package forward
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/config"
+	"github.com/fkocharli/metricity/internal/handlers"
+	"github.com/fkocharli/metricity/internal/repositories"
+	"github.com/fkocharli/metricity/internal/static"
+	"github.com/fkocharli/metricity/internal/storage/memorystorage"
+	"github.com/fkocharli/metricity/internal/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// central is an upstream metricity server that fails with the given statuses first.
+type central struct {
+	*httptest.Server
+	Storager repositories.Storager
+	Mutex    *sync.Mutex
+	statuses []int
+	requests int
+}
+
+func newCentral(t *testing.T, key string, statuses ...int) *central {
+	c := &central{
+		Storager: repositories.NewStorager(memorystorage.NewRepository(), nil, key),
+		Mutex:    &sync.Mutex{},
+		statuses: statuses,
+	}
+	templates, err := static.Templates("")
+	require.NoError(t, err)
+	h := handlers.NewHandler(c.Storager, config.ServerConfig{MaxBodySize: 1 << 20, MaxBatchSize: 1000}, templates)
+
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/updates/", r.URL.Path)
+
+		c.Mutex.Lock()
+		c.requests++
+		var status int
+		if len(c.statuses) > 0 {
+			status, c.statuses = c.statuses[0], c.statuses[1:]
+		}
+		c.Mutex.Unlock()
+
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *central) value(t *testing.T, mtype, id string) repositories.Metrics {
+	m, err := c.Storager.GetMetric(context.Background(), repositories.Metrics{ID: id, MType: mtype})
+	require.NoError(t, err)
+	return m
+}
+
+func TestRelay(t *testing.T) {
+	ctx := context.Background()
+	c := newCentral(t, "secret")
+
+	relay := repositories.NewStorager(memorystorage.NewRepository(), nil, "")
+	upstream, err := New(strings.TrimPrefix(c.URL, "http://"), "secret", time.Second, 2)
+	require.NoError(t, err)
+	relay.Forwarders = []repositories.Forwarder{upstream}
+
+	for _, m := range []repositories.Metrics{testutil.Counter("PollCount", 2), testutil.Gauge("Alloc", 1), testutil.Counter("PollCount", 3)} {
+		_, err := relay.UpdateMetrics(ctx, m)
+		require.NoError(t, err)
+	}
+	_, err = relay.UpdateBatchMetrics(ctx, []repositories.Metrics{testutil.Gauge("Alloc", 7), testutil.Gauge("HeapAlloc", 4), {ID: "Bad", MType: "gauge"}}, repositories.BatchBestEffort)
+	require.NoError(t, err)
+
+	// Three distinct metrics are pending: two batches of at most two.
+	assert.Equal(t, 3, upstream.Pending())
+	require.NoError(t, upstream.Flush(ctx))
+	assert.Equal(t, 0, upstream.Pending())
+	assert.Equal(t, 2, c.requests)
+
+	assert.Equal(t, int64(5), *c.value(t, "counter", "PollCount").Delta)
+	assert.Equal(t, 7.0, *c.value(t, "gauge", "Alloc").Value)
+	assert.Equal(t, 4.0, *c.value(t, "gauge", "HeapAlloc").Value)
+}
+
+func TestBufferAndRetry(t *testing.T) {
+	ctx := context.Background()
+	c := newCentral(t, "", http.StatusServiceUnavailable)
+	upstream, err := New(c.URL+"/", "", time.Second, 0)
+	require.NoError(t, err)
+
+	upstream.Forward(testutil.Counter("PollCount", 1), testutil.Gauge("Alloc", 1))
+	assert.Error(t, upstream.Flush(ctx))
+	assert.Equal(t, 2, upstream.Pending())
+
+	// Updates buffered while the upstream is down merge with the unsent ones.
+	upstream.Forward(testutil.Counter("PollCount", 2), testutil.Gauge("Alloc", 2))
+	require.NoError(t, upstream.Flush(ctx))
+	assert.Equal(t, int64(3), *c.value(t, "counter", "PollCount").Delta)
+	assert.Equal(t, 2.0, *c.value(t, "gauge", "Alloc").Value)
+
+	// Refused batches aren't retried forever.
+	c.statuses = []int{http.StatusBadRequest}
+	upstream.Forward(testutil.Counter("PollCount", 1))
+	require.NoError(t, upstream.Flush(ctx))
+	assert.Equal(t, 0, upstream.Pending())
+	assert.Equal(t, int64(3), *c.value(t, "counter", "PollCount").Delta)
+}
+
+func TestRunFlushesOnShutdown(t *testing.T) {
+	c := newCentral(t, "")
+	upstream, err := New(c.URL, "", time.Hour, 100)
+	require.NoError(t, err)
+
+	_, err = New(c.URL, "", 0, 100)
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		upstream.Run(ctx)
+	}()
+
+	upstream.Forward(testutil.Gauge("Alloc", 3))
+	cancel()
+	<-done
+
+	assert.Equal(t, 3.0, *c.value(t, "gauge", "Alloc").Value)
+}
+
+func TestNextBackoff(t *testing.T) {
+	d := nextBackoff(0, time.Second)
+	assert.Equal(t, time.Second, d)
+	d = nextBackoff(d, time.Second)
+	assert.Equal(t, 2*time.Second, d)
+	assert.Equal(t, maxBackoff, nextBackoff(50*time.Second, time.Second))
+}
@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// alerts lists the state of every alert rule. It's 404 when alerting is disabled.
+func (s *ServerHandlers) alerts(w http.ResponseWriter, r *http.Request) {
+	if s.Alerts == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Alerts.Alerts()); err != nil {
+		log.Println(err)
+	}
+}
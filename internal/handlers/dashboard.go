@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/registry"
+	"github.com/fkocharli/metricity/internal/repositories"
+)
+
+const (
+	sparklineWidth  = 120
+	sparklineHeight = 24
+)
+
+type dashboard struct {
+	Groups          []dashboardGroup
+	Refresh         int
+	SparklineWidth  int
+	SparklineHeight int
+}
+
+type dashboardGroup struct {
+	Type string
+	Rows []dashboardRow
+}
+
+type dashboardRow struct {
+	ID            string
+	Value         string
+	Help          string
+	Meta          *registry.Metric
+	UpdatedMillis int64
+	Sparkline     string
+}
+
+// newDashboard groups the metrics by type, in the order ListMetrics returns them,
+// and attaches their metadata, last update time and recent history.
+func (s *ServerHandlers) newDashboard(metrics []repositories.Metrics) dashboard {
+	d := dashboard{
+		Groups: []dashboardGroup{
+			{Type: "gauge", Rows: []dashboardRow{}},
+			{Type: "counter", Rows: []dashboardRow{}},
+		},
+		Refresh:         int(s.DashboardRefresh / time.Second),
+		SparklineWidth:  sparklineWidth,
+		SparklineHeight: sparklineHeight,
+	}
+
+	for _, m := range metrics {
+		row := dashboardRow{
+			ID:        m.ID,
+			Help:      s.Storager.Registry.Help(m.ID),
+			Meta:      s.metaFor(m.ID),
+			Sparkline: sparkline(s.Storager.History.Series(m.MType, m.ID), sparklineWidth, sparklineHeight),
+		}
+		if t, ok := s.Storager.History.Updated(m.MType, m.ID); ok {
+			row.UpdatedMillis = t.UnixNano() / int64(time.Millisecond)
+		}
+
+		switch {
+		case m.MType == "gauge" && m.Value != nil:
+			row.Value = strconv.FormatFloat(*m.Value, 'g', -1, 64)
+			d.Groups[0].Rows = append(d.Groups[0].Rows, row)
+		case m.MType == "counter" && m.Delta != nil:
+			row.Value = strconv.FormatInt(*m.Delta, 10)
+			d.Groups[1].Rows = append(d.Groups[1].Rows, row)
+		}
+	}
+
+	return d
+}
+
+// sparkline returns the points of an SVG polyline drawing the values scaled to
+// width x height, or an empty string when there are fewer than two points.
+func sparkline(points []repositories.Point, width, height float64) string {
+	if len(points) < 2 {
+		return ""
+	}
+
+	lo, hi := points[0].Value, points[0].Value
+	for _, p := range points {
+		if p.Value < lo {
+			lo = p.Value
+		}
+		if p.Value > hi {
+			hi = p.Value
+		}
+	}
+
+	// Keep a pixel of margin so the stroke isn't clipped at the edges.
+	const margin = 1
+	step := width / float64(len(points)-1)
+	var b strings.Builder
+	for i, p := range points {
+		y := height / 2
+		if hi > lo {
+			y = margin + (hi-p.Value)/(hi-lo)*(height-2*margin)
+		}
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%.1f,%.1f", float64(i)*step, y)
+	}
+	return b.String()
+}
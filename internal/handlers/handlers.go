@@ -1,84 +1,156 @@
 package handlers
 
 import (
-	"compress/gzip"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"io"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
+	"time"
 
+	"github.com/fkocharli/metricity/internal/alerting"
+	"github.com/fkocharli/metricity/internal/config"
+	"github.com/fkocharli/metricity/internal/ratelimit"
+	"github.com/fkocharli/metricity/internal/registry"
 	"github.com/fkocharli/metricity/internal/repositories"
 	"github.com/fkocharli/metricity/internal/server"
+	"github.com/fkocharli/metricity/internal/static"
+	"github.com/fkocharli/metricity/internal/webhooks"
 
 	"github.com/go-chi/chi/v5"
 )
 
 type ServerHandlers struct {
 	*chi.Mux
-	Storager repositories.Storager
+	Storager     repositories.Storager
+	Limiter      *ratelimit.Limiter
+	MaxBodySize  int64
+	MaxBatchSize int
+	// DashboardRefresh is how often the home page reloads its data, 0 disables it.
+	DashboardRefresh time.Duration
+	Templates        *template.Template
+	// Alerts is the alerting engine behind /alerts, nil when no rules are configured.
+	Alerts *alerting.Engine
+	// Webhooks manages the subscriptions behind /webhooks/, nil disables the API.
+	Webhooks *webhooks.Manager
+	// TrustedProxies are the proxies whose X-Forwarded-For and X-Real-IP headers
+	// give the client address, see realIP.
+	TrustedProxies []*net.IPNet
+
+	promFamilies *familyTypes
+	counters     *counterSeries
+	deltaGauges  seriesLocks
 }
 
-func NewHandler(s repositories.Storager) *ServerHandlers {
+func NewHandler(s repositories.Storager, cfg config.ServerConfig, templates *template.Template) *ServerHandlers {
 
 	sh := &ServerHandlers{
-		Mux:      server.NewRouter(),
-		Storager: s,
+		Mux:          server.NewRouter(),
+		Storager:     s,
+		MaxBodySize:  cfg.MaxBodySize,
+		MaxBatchSize: cfg.MaxBatchSize,
+
+		DashboardRefresh: cfg.DashboardRefresh,
+		Templates:        templates,
+
+		promFamilies: newFamilyTypes(),
+		counters:     newCounterSeries(),
+	}
+
+	if cfg.RateLimit > 0 {
+		sh.Limiter = ratelimit.New(cfg.RateLimit, cfg.RateBurst)
 	}
 
-	sh.Mux.Post("/update/", sh.updateJSON)
-	sh.Mux.Post("/updates/", sh.batchUpdates)
-	sh.Mux.Post("/update/{type}/{metricname}/{metricvalue}", sh.update)
+	sh.Mux.Use(sh.realIP)
+
+	sh.Mux.Group(func(r chi.Router) {
+		r.Use(sh.rateLimit, sh.limitBody)
+
+		r.Post("/update/", sh.updateJSON)
+		r.With(sh.decompressBody).Post("/updates/", sh.batchUpdates)
+		r.Post("/update/{type}/{metricname}/{metricvalue}", sh.update)
+		r.With(sh.requireKey).Put("/meta/{metricname}", sh.putMeta)
+		r.With(sh.requireKey).Delete("/meta/{metricname}", sh.deleteMeta)
+		r.With(sh.requireKey).Post("/webhooks/", sh.addWebhook)
+		r.With(sh.requireKey).Delete("/webhooks/{id}", sh.deleteWebhook)
+		r.With(sh.requireKey).Post("/api/v1/write", sh.promWrite)
+		r.With(sh.requireKey, sh.decompressBody).Post("/write", sh.influxWrite)
+		r.With(sh.requireKey, sh.decompressBody).Post("/v1/metrics", sh.otlpMetrics)
+	})
 
 	sh.Mux.Post("/value/", sh.valueJSON)
 	sh.Mux.Get("/value/{type}/{metricname}", sh.value)
+	sh.Mux.Get("/meta/{metricname}", sh.getMeta)
+	sh.Mux.Get("/stream", sh.stream)
+	sh.Mux.Get("/alerts", sh.alerts)
+	sh.Mux.Get("/webhooks/", sh.listWebhooks)
+	sh.Mux.Get("/webhooks/{id}", sh.getWebhook)
 
 	sh.Mux.Get("/ping", sh.ping)
 
+	assets, err := fs.Sub(static.Assets, "assets")
+	if err != nil {
+		panic(err)
+	}
+	sh.Mux.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(http.FS(assets))))
+
 	sh.Mux.Get("/", sh.home)
 	return sh
 
 }
 
+// batchUpdates writes a JSON array of metrics. The mode query parameter selects
+// all-or-nothing ("atomic", default) or "best-effort" handling of invalid metrics;
+// the response lists accepted and rejected items either way.
 func (s *ServerHandlers) batchUpdates(w http.ResponseWriter, r *http.Request) {
 	metricsList := []repositories.Metrics{}
 
-	var reader io.Reader
-
-	if r.Header.Get(`Content-Encoding`) == `gzip` {
-		gz, err := gzip.NewReader(r.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		reader = gz
-		defer gz.Close()
-	} else {
-		reader = r.Body
+	mode, err := repositories.ParseBatchMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if err := json.NewDecoder(reader).Decode(&metricsList); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&metricsList); err != nil {
 		log.Println(err)
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	defer r.Body.Close()
 
+	if s.MaxBatchSize > 0 && len(metricsList) > s.MaxBatchSize {
+		log.Printf("Batch of %d metrics exceeds limit of %d", len(metricsList), s.MaxBatchSize)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
 	log.Printf("Received Batch Update for following metrics: %v", metricsList)
 
-	err := s.Storager.UpdateBatchMetrics(metricsList)
+	res, err := s.Storager.UpdateBatchMetrics(r.Context(), metricsList, mode)
+	status := http.StatusOK
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		if err != repositories.ErrBatchRejected {
+			w.WriteHeader(storageErrorStatus(err))
+			return
+		}
+		status = http.StatusBadRequest
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Println(err)
+	}
 }
 
 func (s *ServerHandlers) updateJSON(w http.ResponseWriter, r *http.Request) {
@@ -87,6 +159,10 @@ func (s *ServerHandlers) updateJSON(w http.ResponseWriter, r *http.Request) {
 
 	if err := metrics.FromJSON(r.Body); err != nil {
 		log.Println(err)
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -95,15 +171,21 @@ func (s *ServerHandlers) updateJSON(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Update Metric: %v\n", metrics)
 
-	metrics, err := s.Storager.UpdateMetrics(metrics)
+	metrics, err := s.Storager.UpdateMetrics(r.Context(), metrics)
 	if err != nil {
 		switch err {
-		case repositories.ErrIncorrectHash, repositories.ErrUndefinedMetricType, repositories.ErrIncorrectCounterValue, repositories.ErrIncorrectGaugeValue:
+		case repositories.ErrIncorrectHash, repositories.ErrUndefinedMetricType, repositories.ErrIncorrectCounterValue, repositories.ErrIncorrectGaugeValue, repositories.ErrEmptyMetricID, registry.ErrTypeMismatch, registry.ErrUnknownMetric:
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		case repositories.ErrUnableUpdateCounter, repositories.ErrUnableUpdateGauge:
 			w.WriteHeader(http.StatusInternalServerError)
 			return
+		case repositories.ErrStorageTimeout:
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		case repositories.ErrStorageCanceled:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
 		default:
 			w.WriteHeader(http.StatusNotImplemented)
 			return
@@ -130,25 +212,31 @@ func (s *ServerHandlers) valueJSON(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("Get Metric: %v\n", metrics)
 
-	metrics, err := s.Storager.GetMetric(metrics)
+	metrics, err := s.Storager.GetMetric(r.Context(), metrics)
 	if err != nil {
 		switch err {
 		case repositories.ErrMetricNotFound:
 			w.WriteHeader(http.StatusNotFound)
 			return
-		case repositories.ErrCantParseCounter, repositories.ErrCantParseGauge:
+		case repositories.ErrCantParseCounter, repositories.ErrCantParseGauge, repositories.ErrStorageFailure:
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		case repositories.ErrUndefinedMetricType:
 			w.WriteHeader(http.StatusBadRequest)
 			return
+		case repositories.ErrStorageTimeout:
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		case repositories.ErrStorageCanceled:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
 		default:
 			w.WriteHeader(http.StatusNotImplemented)
 			return
 		}
 	}
 
-	res, err := json.Marshal(metrics)
+	res, err := json.Marshal(valueResponse{Metrics: metrics, Meta: s.metaFor(metrics.ID)})
 	if err != nil {
 		log.Printf("Error: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -191,10 +279,10 @@ func (s *ServerHandlers) update(w http.ResponseWriter, r *http.Request) {
 		metrics.Value = &n
 	}
 
-	metrics, err := s.Storager.UpdateMetrics(metrics)
+	metrics, err := s.Storager.UpdateMetrics(r.Context(), metrics)
 	if err != nil {
 		switch err {
-		case repositories.ErrIncorrectHash, repositories.ErrIncorrectCounterValue, repositories.ErrIncorrectGaugeValue:
+		case repositories.ErrIncorrectHash, repositories.ErrIncorrectCounterValue, repositories.ErrIncorrectGaugeValue, repositories.ErrEmptyMetricID, registry.ErrTypeMismatch, registry.ErrUnknownMetric:
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		case repositories.ErrUnableUpdateCounter, repositories.ErrUnableUpdateGauge:
@@ -203,6 +291,12 @@ func (s *ServerHandlers) update(w http.ResponseWriter, r *http.Request) {
 		case repositories.ErrUndefinedMetricType:
 			w.WriteHeader(http.StatusNotImplemented)
 			return
+		case repositories.ErrStorageTimeout:
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		case repositories.ErrStorageCanceled:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
 		default:
 			w.WriteHeader(http.StatusNotImplemented)
 			return
@@ -219,18 +313,24 @@ func (s *ServerHandlers) value(w http.ResponseWriter, r *http.Request) {
 
 	metrics := repositories.Metrics{ID: n, MType: t}
 
-	metrics, err := s.Storager.GetMetric(metrics)
+	metrics, err := s.Storager.GetMetric(r.Context(), metrics)
 	if err != nil {
 		switch err {
 		case repositories.ErrMetricNotFound:
 			w.WriteHeader(http.StatusNotFound)
 			return
-		case repositories.ErrCantParseCounter, repositories.ErrCantParseGauge:
+		case repositories.ErrCantParseCounter, repositories.ErrCantParseGauge, repositories.ErrStorageFailure:
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		case repositories.ErrUndefinedMetricType:
 			w.WriteHeader(http.StatusBadRequest)
 			return
+		case repositories.ErrStorageTimeout:
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		case repositories.ErrStorageCanceled:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
 		default:
 			w.WriteHeader(http.StatusNotImplemented)
 			return
@@ -248,27 +348,29 @@ func (s *ServerHandlers) value(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *ServerHandlers) home(w http.ResponseWriter, r *http.Request) {
-	wd, err := os.Getwd()
+	metrics, err := s.Storager.ListMetrics(r.Context())
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Unable to get metrics. Error: %v", err)
+		w.WriteHeader(storageErrorStatus(err))
+		return
 	}
 
-	tmplPath := filepath.Join(wd, "internal", "static", "html", "index.html")
-
-	if filepath.Base(wd) == "server" {
-		tmplPath = filepath.Join(filepath.Dir(filepath.Dir(wd)), "internal", "static", "html", "index.html")
+	// Render into a buffer first, so a broken custom template yields a 500
+	// instead of a truncated page.
+	var page bytes.Buffer
+	if err := s.Templates.ExecuteTemplate(&page, "index.html", s.newDashboard(metrics)); err != nil {
+		log.Printf("Unable to render home page. Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	t := template.Must(template.ParseFiles(tmplPath))
-	data := s.Storager.GetAllMetrics()
-
 	w.Header().Add("Content-Type", "text/html")
-	t.Execute(w, data)
 	w.WriteHeader(http.StatusOK)
+	w.Write(page.Bytes())
 }
 
 func (s *ServerHandlers) ping(w http.ResponseWriter, r *http.Request) {
-	err := s.Storager.Repo.Ping()
+	err := s.Storager.Repo.Ping(r.Context())
 	if err != nil {
 		log.Printf("Unable ping DB. Error: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -276,3 +378,16 @@ func (s *ServerHandlers) ping(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 }
+
+// storageErrorStatus maps storage faults to 504 on timeouts, 503 on
+// cancellation and 500 otherwise.
+func storageErrorStatus(err error) int {
+	switch err {
+	case repositories.ErrStorageTimeout:
+		return http.StatusGatewayTimeout
+	case repositories.ErrStorageCanceled:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
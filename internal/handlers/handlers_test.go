@@ -1,11 +1,38 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/fkocharli/metricity/internal/alerting"
+	"github.com/fkocharli/metricity/internal/config"
+	"github.com/fkocharli/metricity/internal/otlp"
+	"github.com/fkocharli/metricity/internal/otlp/otlptest"
+	"github.com/fkocharli/metricity/internal/prompb"
+	"github.com/fkocharli/metricity/internal/prompb/prompbtest"
+	"github.com/fkocharli/metricity/internal/registry"
 	"github.com/fkocharli/metricity/internal/repositories"
+	"github.com/fkocharli/metricity/internal/static"
+	"github.com/fkocharli/metricity/internal/storage/memorystorage"
+	"github.com/fkocharli/metricity/internal/testutil"
+	"github.com/fkocharli/metricity/internal/webhooks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -14,35 +41,35 @@ type MockStorageType struct {
 	MockField string
 }
 
-func (m MockStorageType) UpdateGaugeMetrics(name, value string) error {
+func (m MockStorageType) UpdateGaugeMetrics(ctx context.Context, name, value string) error {
 
 	return nil
 }
 
-func (m MockStorageType) UpdateCounterMetrics(name, value string) (int64, error) {
+func (m MockStorageType) UpdateCounterMetrics(ctx context.Context, name, value string) (int64, error) {
 	return 0, nil
 }
 
-func (m MockStorageType) GetGaugeMetrics(name string) (string, error) {
+func (m MockStorageType) GetGaugeMetrics(ctx context.Context, name string) (string, error) {
 	return "", nil
 }
 
-func (m MockStorageType) GetCounterMetrics(name string) (string, error) {
+func (m MockStorageType) GetCounterMetrics(ctx context.Context, name string) (string, error) {
 	return "", nil
 }
 
-func (m MockStorageType) GetAllCounterMetrics() []repositories.Metrics {
-	return nil
+func (m MockStorageType) GetAllCounterMetrics(ctx context.Context) ([]repositories.Metrics, error) {
+	return nil, nil
 }
 
-func (m MockStorageType) GetAllGaugeMetrics() []repositories.Metrics {
-	return nil
+func (m MockStorageType) GetAllGaugeMetrics(ctx context.Context) ([]repositories.Metrics, error) {
+	return nil, nil
 }
 
-func (m MockStorageType) UpdateBatchMetrics(metrics []repositories.Metrics) error {
+func (m MockStorageType) UpdateBatchMetrics(ctx context.Context, metrics []repositories.Metrics) error {
 	return nil
 }
-func (m MockStorageType) Ping() error {
+func (m MockStorageType) Ping(ctx context.Context) error {
 	return nil
 }
 
@@ -61,7 +88,7 @@ func TestHandlers(t *testing.T) {
 
 	mockRepo := repositories.Storager{Repo: mockMemRepo, FileRepo: nil, Key: ""}
 
-	handler := NewHandler(mockRepo)
+	handler := NewHandler(mockRepo, config.ServerConfig{}, testTemplates(t, ""))
 
 	tests := []struct {
 		name string
@@ -94,7 +121,7 @@ func TestHandlers(t *testing.T) {
 		},
 	}
 
-	r := NewHandler(mockRepo)
+	r := NewHandler(mockRepo, config.ServerConfig{}, testTemplates(t, ""))
 	s := httptest.NewServer(r)
 	defer s.Close()
 	for _, tt := range tests {
@@ -111,3 +138,975 @@ func TestHandlers(t *testing.T) {
 		})
 	}
 }
+
+func TestIngestionLimits(t *testing.T) {
+	mockRepo := repositories.Storager{Repo: MockStorageType{}, FileRepo: nil, Key: ""}
+
+	handler := NewHandler(mockRepo, config.ServerConfig{
+		MaxBodySize:  256,
+		MaxBatchSize: 2,
+		RateLimit:    1,
+		RateBurst:    5,
+	}, testTemplates(t, ""))
+	s := httptest.NewServer(handler)
+	defer s.Close()
+
+	post := func(path, body, agent string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, s.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Agent-ID", agent)
+		req.Header.Set("X-Forwarded-For", "198.51.100."+strconv.Itoa(len(agent)))
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := post("/updates/", `[{"id":"a","type":"gauge","value":1},{"id":"b","type":"gauge","value":1},{"id":"c","type":"gauge","value":1}]`, "batch")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	resp = post("/update/", `{"id":"`+strings.Repeat("a", 300)+`","type":"gauge","value":1}`, "body")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// The two requests above took from the same bucket.
+	for i := 0; i < 3; i++ {
+		resp = post("/update/", `{"id":"a","type":"gauge","value":1}`, "rate")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	resp = post("/update/", `{"id":"a","type":"gauge","value":1}`, "rate")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	// Other agent IDs and forwarded addresses don't get a fresh bucket.
+	resp = post("/update/", `{"id":"a","type":"gauge","value":1}`, "other")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	// Behind a trusted proxy, the forwarded address is the client.
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "127.0.0.1"})
+	require.NoError(t, err)
+	handler.TrustedProxies = proxies
+	resp = post("/update/", `{"id":"a","type":"gauge","value":1}`, "other")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = ParseTrustedProxies([]string{"proxy.local"})
+	assert.Error(t, err)
+}
+
+func TestRealIP(t *testing.T) {
+	h := newTestHandler(t, "", config.ServerConfig{})
+	var err error
+	h.TrustedProxies, err = ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		remote, forwardedFor, realIP, want string
+	}{
+		{remote: "203.0.113.7:1234", forwardedFor: "198.51.100.1", want: "203.0.113.7:1234"},
+		{remote: "192.0.2.1:1234", forwardedFor: "198.51.100.1", want: "198.51.100.1"},
+		{remote: "192.0.2.1:1234", forwardedFor: "198.51.100.9, 198.51.100.1, 10.0.0.2", want: "198.51.100.1"},
+		{remote: "192.0.2.1:1234", realIP: "198.51.100.1", want: "198.51.100.1"},
+		{remote: "192.0.2.1:1234", want: "192.0.2.1:1234"},
+	} {
+		var got string
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r.RemoteAddr })
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		h.realIP(next).ServeHTTP(httptest.NewRecorder(), r)
+		assert.Equal(t, tt.want, got, "%+v", tt)
+	}
+}
+
+type timeoutStorage struct {
+	MockStorageType
+}
+
+func (m timeoutStorage) UpdateGaugeMetrics(ctx context.Context, name, value string) error {
+	return context.DeadlineExceeded
+}
+
+func (m timeoutStorage) GetCounterMetrics(ctx context.Context, name string) (string, error) {
+	return "", context.Canceled
+}
+
+func TestStorageTimeouts(t *testing.T) {
+	mockRepo := repositories.Storager{Repo: timeoutStorage{}, FileRepo: nil, Key: ""}
+
+	s := httptest.NewServer(NewHandler(mockRepo, config.ServerConfig{}, testTemplates(t, "")))
+	defer s.Close()
+
+	resp, err := http.Post(s.URL+"/update/gauge/Alloc/1", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+
+	resp, err = http.Get(s.URL + "/value/counter/PollCount")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+type failingStorage struct {
+	MockStorageType
+}
+
+func (m failingStorage) GetGaugeMetrics(ctx context.Context, name string) (string, error) {
+	return "", errors.New("connection refused")
+}
+
+func (m failingStorage) GetCounterMetrics(ctx context.Context, name string) (string, error) {
+	return "", fmt.Errorf("%w: counter %s", repositories.ErrMetricNotFound, name)
+}
+
+func (m failingStorage) GetAllGaugeMetrics(ctx context.Context) ([]repositories.Metrics, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestStorageReadErrors(t *testing.T) {
+	mockRepo := repositories.Storager{Repo: failingStorage{}, FileRepo: nil, Key: ""}
+
+	s := httptest.NewServer(NewHandler(mockRepo, config.ServerConfig{}, testTemplates(t, "")))
+	defer s.Close()
+
+	tests := []struct {
+		path       string
+		statusCode int
+	}{
+		{path: "/value/gauge/Alloc", statusCode: http.StatusInternalServerError},
+		{path: "/value/counter/PollCount", statusCode: http.StatusNotFound},
+		{path: "/", statusCode: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get(s.URL + tt.path)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestBatchModes(t *testing.T) {
+	mockRepo := repositories.NewStorager(memorystorage.NewRepository(), nil, "")
+
+	s := httptest.NewServer(NewHandler(mockRepo, config.ServerConfig{}, testTemplates(t, "")))
+	defer s.Close()
+
+	batch := `[{"id":"Alloc","type":"gauge","value":1},{"id":"PollCount","type":"counter"},{"id":"Frees","type":"gauge","value":2},{"id":"X","type":"histogram"}]`
+
+	post := func(path string) (*http.Response, repositories.BatchResult) {
+		resp, err := http.Post(s.URL+path, "application/json", strings.NewReader(batch))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var res repositories.BatchResult
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return resp, res
+	}
+
+	resp, res := post("/updates/")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Empty(t, res.Accepted)
+	assert.Len(t, res.Rejected, 4)
+
+	_, err := mockRepo.GetMetric(context.Background(), repositories.Metrics{ID: "Alloc", MType: "gauge"})
+	assert.Equal(t, repositories.ErrMetricNotFound, err)
+
+	resp, res = post("/updates/?mode=best-effort")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, res.Accepted, 2)
+	require.Len(t, res.Rejected, 2)
+	assert.Equal(t, 1, res.Rejected[0].Index)
+	assert.Equal(t, repositories.ErrIncorrectCounterValue.Error(), res.Rejected[0].Error)
+	assert.Equal(t, repositories.ErrUndefinedMetricType.Error(), res.Rejected[1].Error)
+
+	v, err := mockRepo.GetMetric(context.Background(), repositories.Metrics{ID: "Frees", MType: "gauge"})
+	require.NoError(t, err)
+	assert.Equal(t, float64(2), *v.Value)
+}
+
+func TestRegistryValidation(t *testing.T) {
+	reg, err := registry.New([]registry.Metric{
+		{Name: "PollCount", Type: "counter", Description: "Number of polls"},
+		{Name: "Alloc", Type: "gauge", Description: "Allocated heap objects", Unit: "bytes"},
+	}, true)
+	require.NoError(t, err)
+
+	storager := repositories.NewStorager(memorystorage.NewRepository(), nil, "")
+	storager.Registry = reg
+
+	s := httptest.NewServer(NewHandler(storager, config.ServerConfig{}, testTemplates(t, "")))
+	defer s.Close()
+
+	tests := []struct {
+		path       string
+		statusCode int
+	}{
+		{path: "/update/counter/PollCount/1", statusCode: http.StatusOK},
+		{path: "/update/gauge/Alloc/1.5", statusCode: http.StatusOK},
+		{path: "/update/gauge/PollCount/1", statusCode: http.StatusBadRequest},
+		{path: "/update/gauge/Unknown/1", statusCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Post(s.URL+tt.path, "text/plain", nil)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestMetaAPI(t *testing.T) {
+	reg, err := registry.New(nil, false)
+	require.NoError(t, err)
+
+	storager := repositories.NewStorager(memorystorage.NewRepository(), nil, "")
+	storager.Registry = reg
+
+	s := httptest.NewServer(NewHandler(storager, config.ServerConfig{}, testTemplates(t, "")))
+	defer s.Close()
+
+	do := func(method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := do(http.MethodGet, "/meta/Alloc", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = do(http.MethodPut, "/meta/Alloc", `{"type":"histogram"}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = do(http.MethodPut, "/meta/Alloc", `{"type":"gauge","description":"Allocated heap objects","unit":"bytes","owner":"runtime"}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do(http.MethodGet, "/meta/Alloc", "")
+	var m registry.Metric
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+	resp.Body.Close()
+	assert.Equal(t, registry.Metric{Name: "Alloc", Type: "gauge", Description: "Allocated heap objects", Unit: "bytes", Owner: "runtime"}, m)
+
+	resp = do(http.MethodPost, "/update/counter/Alloc/1", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = do(http.MethodPost, "/update/gauge/Alloc/1.5", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do(http.MethodPost, "/value/", `{"id":"Alloc","type":"gauge"}`)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.JSONEq(t, `{"id":"Alloc","type":"gauge","value":1.5,"meta":{"name":"Alloc","type":"gauge","description":"Allocated heap objects","unit":"bytes","owner":"runtime"}}`, string(body))
+
+	resp = do(http.MethodDelete, "/meta/Alloc", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = do(http.MethodDelete, "/meta/Alloc", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// With a key set, changing metadata requires it.
+	storager.Key = "secret"
+	h := NewHandler(storager, config.ServerConfig{}, testTemplates(t, ""))
+	for _, auth := range []string{"", "Bearer secret"} {
+		for _, method := range []string{http.MethodPut, http.MethodDelete} {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, "/meta/Alloc", strings.NewReader(`{"type":"gauge"}`))
+			req.Header.Set("Authorization", auth)
+			h.ServeHTTP(w, req)
+			assert.Equal(t, auth == "", w.Code == http.StatusUnauthorized, "%s %q", method, auth)
+		}
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	storager := repositories.NewStorager(memorystorage.NewRepository(), nil, "")
+	storager.History = repositories.NewHistory(3)
+	storager.Registry, _ = registry.New([]registry.Metric{{Name: "Alloc", Type: "gauge", Unit: "bytes"}}, false)
+
+	ctx := context.Background()
+	for _, v := range []float64{1, 3, 2, 5} {
+		v := v
+		_, err := storager.UpdateMetrics(ctx, repositories.Metrics{ID: "Alloc", MType: "gauge", Value: &v})
+		require.NoError(t, err)
+
+		metrics, err := storager.ListMetrics(ctx)
+		require.NoError(t, err)
+		storager.History.Sample(metrics)
+	}
+	delta := int64(4)
+	_, err := storager.UpdateMetrics(ctx, repositories.Metrics{ID: "PollCount", MType: "counter", Delta: &delta})
+	require.NoError(t, err)
+
+	sh := NewHandler(storager, config.ServerConfig{DashboardRefresh: 5 * time.Second}, testTemplates(t, ""))
+	metrics, err := storager.ListMetrics(ctx)
+	require.NoError(t, err)
+
+	d := sh.newDashboard(metrics)
+	assert.Equal(t, 5, d.Refresh)
+	require.Len(t, d.Groups, 2)
+
+	require.Len(t, d.Groups[0].Rows, 1)
+	gauge := d.Groups[0].Rows[0]
+	assert.Equal(t, "5", gauge.Value)
+	assert.Equal(t, "bytes", gauge.Meta.Unit)
+	assert.NotZero(t, gauge.UpdatedMillis)
+	// Only the last 3 samples are kept: 3, 2, 5.
+	assert.Equal(t, "0.0,15.7 60.0,23.0 120.0,1.0", gauge.Sparkline)
+
+	require.Len(t, d.Groups[1].Rows, 1)
+	assert.Equal(t, "4", d.Groups[1].Rows[0].Value)
+	assert.Empty(t, d.Groups[1].Rows[0].Sparkline)
+
+	s := httptest.NewServer(sh)
+	defer s.Close()
+
+	for _, path := range []string{"/static/dashboard.js", "/static/dashboard.css"} {
+		resp, err := http.Get(s.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+	}
+}
+
+func TestHomeTemplates(t *testing.T) {
+	storager := repositories.NewStorager(memorystorage.NewRepository(), nil, "")
+	value := float64(42)
+	_, err := storager.UpdateMetrics(context.Background(), repositories.Metrics{ID: "Alloc", MType: "gauge", Value: &value})
+	require.NoError(t, err)
+
+	custom := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(custom, "index.html"), []byte(`{{range .Groups}}{{range .Rows}}{{.ID}}={{.Value}};{{end}}{{end}}`), 0644))
+
+	tests := []struct {
+		name string
+		dir  string
+		body string
+	}{
+		{name: "embedded", body: `<tr data-name="Alloc"`},
+		{name: "override", dir: custom, body: "Alloc=42;"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := httptest.NewServer(NewHandler(storager, config.ServerConfig{}, testTemplates(t, tt.dir)))
+			defer s.Close()
+
+			resp, err := http.Get(s.URL + "/")
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Contains(t, string(body), tt.body)
+		})
+	}
+
+	_, err = static.Templates(filepath.Join(custom, "missing"))
+	assert.Error(t, err)
+}
+
+// testHandler is a handler backed by the in-memory store.
+type testHandler struct {
+	*ServerHandlers
+	t *testing.T
+}
+
+func newTestHandler(t *testing.T, key string, cfg config.ServerConfig) *testHandler {
+	storager := repositories.NewStorager(memorystorage.NewRepository(), nil, key)
+	return &testHandler{ServerHandlers: NewHandler(storager, cfg, testTemplates(t, "")), t: t}
+}
+
+// get returns the stored metric and fails the test if there is none.
+func (h *testHandler) get(mtype, id string) repositories.Metrics {
+	h.t.Helper()
+
+	m, err := h.Storager.GetMetric(context.Background(), repositories.Metrics{ID: id, MType: mtype})
+	require.NoError(h.t, err)
+	return m
+}
+
+func testTemplates(t *testing.T, dir string) *template.Template {
+	t.Helper()
+
+	tmpl, err := static.Templates(dir)
+	require.NoError(t, err)
+	return tmpl
+}
+
+func TestStream(t *testing.T) {
+	storager := repositories.NewStorager(memorystorage.NewRepository(), nil, "")
+	storager.Broker = repositories.NewBroker()
+
+	s := httptest.NewServer(NewHandler(storager, config.ServerConfig{}, testTemplates(t, "")))
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/stream?type=histogram")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Get(s.URL + "/stream?prefix=Heap&type=gauge")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := bufio.NewReader(resp.Body)
+	line, err := events.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, ": connected\n", line)
+
+	for _, path := range []string{"/update/gauge/Alloc/1", "/update/counter/HeapCount/1", "/update/gauge/HeapAlloc/2"} {
+		resp, err := http.Post(s.URL+path, "text/plain", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	resp2, err := http.Post(s.URL+"/updates/", "application/json", strings.NewReader(`[{"id":"HeapInuse","type":"gauge","value":3},{"id":"Frees","type":"gauge","value":4}]`))
+	require.NoError(t, err)
+	resp2.Body.Close()
+
+	var got []string
+	for len(got) < 2 {
+		line, err := events.ReadString('\n')
+		require.NoError(t, err)
+		if strings.HasPrefix(line, "data: ") {
+			got = append(got, strings.TrimSpace(strings.TrimPrefix(line, "data: ")))
+		}
+	}
+	assert.Equal(t, []string{`{"id":"HeapAlloc","type":"gauge","value":2}`, `{"id":"HeapInuse","type":"gauge","value":3}`}, got)
+
+	// Closing the broker ends the stream.
+	storager.Broker.Close()
+	_, err = io.ReadAll(events)
+	assert.NoError(t, err)
+}
+
+func TestAlerts(t *testing.T) {
+	h := newTestHandler(t, "", config.ServerConfig{})
+
+	r := httptest.NewRequest(http.MethodGet, "/alerts", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	engine, err := alerting.New([]alerting.Rule{{Name: "high-alloc", Metric: "Alloc", Type: "gauge", Op: alerting.OpGreater, Threshold: 100}}, &h.Storager, time.Minute)
+	require.NoError(t, err)
+	h.Alerts = engine
+	engine.Observe(context.Background(), testutil.Gauge("Alloc", 150))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/alerts", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var got []alerting.Alert
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	require.Len(t, got, 1)
+	assert.Equal(t, "high-alloc", got[0].Rule)
+	assert.Equal(t, alerting.StateFiring, got[0].State)
+}
+
+func TestWebhooksAPI(t *testing.T) {
+	h := newTestHandler(t, "", config.ServerConfig{MaxBodySize: 1024})
+	h.Storager.Broker = repositories.NewBroker()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhooks/", strings.NewReader(`{"url":"http://localhost:9000/hook"}`)))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+
+	var err error
+	h.Webhooks, err = webhooks.New("", h.Storager.Broker)
+	require.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhooks/", strings.NewReader(`{"url":"http://localhost:9000/hook","prefix":"Heap","secret":"s3cret"}`)))
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.NotContains(t, w.Body.String(), "s3cret")
+
+	var created struct {
+		ID     string `json:"id"`
+		Signed bool   `json:"signed"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.True(t, created.Signed)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhooks/", strings.NewReader(`{"url":"localhost"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/webhooks/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[{"id":"`+created.ID+`","url":"http://localhost:9000/hook","prefix":"Heap","signed":true}]`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/webhooks/"+created.ID, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/webhooks/"+created.ID, nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/webhooks/"+created.ID, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// With a key set, subscribing and unsubscribing require it.
+	h.Storager.Key = "secret"
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhooks/", strings.NewReader(`{"url":"http://localhost:9000/hook"}`)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/", strings.NewReader(`{"url":"http://localhost:9000/hook"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	h.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/webhooks/"+created.ID, nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestPrometheusRemoteWrite(t *testing.T) {
+	h := newTestHandler(t, "secret", config.ServerConfig{MaxBodySize: 1 << 20, MaxBatchSize: 2})
+
+	write := func(req prompb.WriteRequest, auth string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(prompbtest.Encode(req)))
+		r.Header.Set("Content-Encoding", "snappy")
+		r.Header.Set("Content-Type", "application/x-protobuf")
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	series := func(value float64, labels ...string) prompb.TimeSeries {
+		ts := prompb.TimeSeries{Samples: []prompb.Sample{{Value: math.NaN(), Timestamp: 3}, {Value: value, Timestamp: 2}, {Value: value - 1, Timestamp: 1}}}
+		for i := 0; i < len(labels); i += 2 {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: labels[i], Value: labels[i+1]})
+		}
+		return ts
+	}
+
+	req := prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			series(10, "__name__", "http_requests_total", "method", "GET", "code", "200"),
+			series(21.5, "__name__", "temperature", "room", `kitchen "A"`),
+			series(7, "__name__", "queue_size"),
+			series(1, "job", "no-name"),
+		},
+		Metadata: []prompb.MetricMetadata{{Type: prompb.Counter, FamilyName: "queue_size"}},
+	}
+	assert.Equal(t, http.StatusUnauthorized, write(req, ""))
+	assert.Equal(t, http.StatusUnauthorized, write(req, "Bearer wrong"))
+	require.Equal(t, http.StatusNoContent, write(req, "Bearer secret"))
+
+	assert.Equal(t, int64(10), *h.get("counter", `http_requests_total{code="200",method="GET"}`).Delta)
+	assert.Equal(t, 21.5, *h.get("gauge", `temperature{room="kitchen \"A\""}`).Value)
+	assert.Equal(t, int64(7), *h.get("counter", "queue_size").Delta)
+
+	// Counters follow the cumulative value, also across a reset in the source.
+	req = prompb.WriteRequest{Timeseries: []prompb.TimeSeries{series(15, "__name__", "queue_size")}}
+	require.Equal(t, http.StatusNoContent, write(req, "Token secret"))
+	assert.Equal(t, int64(15), *h.get("counter", "queue_size").Delta)
+
+	req = prompb.WriteRequest{Timeseries: []prompb.TimeSeries{series(4, "__name__", "queue_size")}}
+	require.Equal(t, http.StatusNoContent, write(req, "Bearer secret"))
+	assert.Equal(t, int64(19), *h.get("counter", "queue_size").Delta)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/write", strings.NewReader("garbage"))
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestPrometheusCounterDetection(t *testing.T) {
+	f := newFamilyTypes()
+	f.set([]prompb.MetricMetadata{
+		{Type: prompb.Histogram, FamilyName: "request_duration_seconds"},
+		{Type: prompb.Gauge, FamilyName: "temperature_count"},
+		{Type: prompb.Counter, FamilyName: "errors"},
+	})
+
+	for name, want := range map[string]bool{
+		"request_duration_seconds_bucket": true,
+		"request_duration_seconds_count":  true,
+		"request_duration_seconds_sum":    false,
+		"temperature_count":               false,
+		"errors_total":                    true,
+		"jobs_total":                      true,
+		"jobs_count":                      true,
+		"memory_bytes":                    false,
+	} {
+		assert.Equal(t, want, f.isCounter(name), name)
+	}
+}
+
+func TestOTLPDeltaSums(t *testing.T) {
+	h := newTestHandler(t, "", config.ServerConfig{MaxBodySize: 1 << 20, MaxBatchSize: 1000})
+
+	export := func(name string, monotonic bool, value float64) {
+		body := fmt.Sprintf(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":%q,"sum":{
+			"aggregationTemporality":1,"isMonotonic":%t,"dataPoints":[{"timeUnixNano":"1","asDouble":%v}]}}]}]}]}`, name, monotonic, value)
+		r := httptest.NewRequest(http.MethodPost, "/v1/metrics", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// Fractional increments add up across exports.
+	for i := 0; i < 5; i++ {
+		export("jobs_total", true, 0.4)
+	}
+	assert.Equal(t, int64(2), *h.get("counter", "jobs_total").Delta)
+
+	// Concurrent exports of a delta gauge don't overwrite each other, even when
+	// reading the stored value takes a while.
+	h.Storager.Repo = slowGauges{h.Storager.Repo}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			export("queue_size", false, 1)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 20.0, *h.get("gauge", "queue_size").Value)
+}
+
+func TestSeriesLocks(t *testing.T) {
+	var l seriesLocks
+	unlock := l.lock([]string{"a", "b"})
+
+	// Other series aren't held up.
+	done := make(chan struct{})
+	go func() {
+		l.lock([]string{"c"})()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("locking another series blocked")
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		l.lock([]string{"b"})()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("series locked twice")
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+
+	l.mu.Lock()
+	assert.Empty(t, l.locks)
+	l.mu.Unlock()
+}
+
+type slowGauges struct {
+	repositories.Storage
+}
+
+func (s slowGauges) GetGaugeMetrics(ctx context.Context, name string) (string, error) {
+	v, err := s.Storage.GetGaugeMetrics(ctx, name)
+	time.Sleep(time.Millisecond)
+	return v, err
+}
+
+func TestDecompressBody(t *testing.T) {
+	h := newTestHandler(t, "", config.ServerConfig{MaxBodySize: 1024})
+
+	post := func(path string, body []byte) int {
+		r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		r.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	compress := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		return buf.Bytes()
+	}
+
+	assert.Equal(t, http.StatusOK, post("/updates/", compress([]byte(`[{"id":"Alloc","type":"gauge","value":1}]`))))
+	for _, path := range []string{"/updates/", "/write", "/v1/metrics"} {
+		assert.Equal(t, http.StatusBadRequest, post(path, []byte("not gzip")), path)
+		// The decompressed body is limited as well.
+		assert.Equal(t, http.StatusRequestEntityTooLarge, post(path, compress(bytes.Repeat([]byte(" "), 4096))), path)
+	}
+}
+
+func TestCumulativeCounter(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHandler(t, "", config.ServerConfig{})
+
+	add := func(value float64, start uint64) int64 {
+		updates := h.counters.begin()
+		m, err := h.cumulativeCounter(ctx, updates, "requests_total", value, start)
+		require.NoError(t, err)
+		_, err = h.ingest(ctx, updates, []repositories.Metrics{m})
+		require.NoError(t, err)
+		return *h.get("counter", "requests_total").Delta
+	}
+
+	assert.Equal(t, int64(10), add(10, 1))
+
+	// Increments from other senders don't make the next value look like a reset.
+	_, err := h.Storager.UpdateMetrics(ctx, testutil.Counter("requests_total", 5))
+	require.NoError(t, err)
+	assert.Equal(t, int64(17), add(12, 1))
+
+	// Fractions are carried over instead of being rounded away on every update.
+	assert.Equal(t, int64(17), add(12.4, 1))
+	assert.Equal(t, int64(18), add(12.8, 1))
+
+	// A new start time is a reset even when the value went up.
+	assert.Equal(t, int64(38), add(20, 2))
+	assert.Equal(t, int64(41), add(3, 2))
+
+	// After a restart the series continues from the stored total.
+	h.counters = newCounterSeries()
+	assert.Equal(t, int64(45), add(45, 2))
+}
+
+func TestCounterRollback(t *testing.T) {
+	h := newTestHandler(t, "", config.ServerConfig{MaxBodySize: 1 << 20, MaxBatchSize: 1000})
+	repo := &flakyStorage{Storage: h.Storager.Repo}
+	h.Storager.Repo = repo
+
+	write := func(body string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/write", strings.NewReader(body)))
+		return w.Code
+	}
+	export := func(value float64) int {
+		body := fmt.Sprintf(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"jobs_total","sum":{
+			"aggregationTemporality":1,"isMonotonic":true,"dataPoints":[{"timeUnixNano":"1","asDouble":%v}]}}]}]}]}`, value)
+		r := httptest.NewRequest(http.MethodPost, "/v1/metrics", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusNoContent, write("a_total value=10"))
+
+	// Reading b_total fails after a_total was resolved: a_total isn't advanced.
+	repo.failRead = "b_total"
+	assert.Equal(t, http.StatusInternalServerError, write("a_total value=15\nb_total value=1"))
+	repo.failRead = ""
+	require.Equal(t, http.StatusNoContent, write("a_total value=20\nb_total value=1"))
+	assert.Equal(t, int64(20), *h.get("counter", "a_total").Delta)
+	assert.Equal(t, int64(1), *h.get("counter", "b_total").Delta)
+
+	// Neither are counters whose write fails.
+	repo.failWrites = true
+	assert.Equal(t, http.StatusInternalServerError, write("a_total value=25"))
+	repo.failWrites = false
+	require.Equal(t, http.StatusNoContent, write("a_total value=30"))
+	assert.Equal(t, int64(30), *h.get("counter", "a_total").Delta)
+
+	// The remainder of a delta counter is put back when the write fails.
+	require.Equal(t, http.StatusOK, export(0.4))
+	repo.failWrites = true
+	assert.Equal(t, http.StatusInternalServerError, export(0.4))
+	repo.failWrites = false
+	require.Equal(t, http.StatusOK, export(0.4))
+	assert.Equal(t, int64(1), *h.get("counter", "jobs_total").Delta)
+}
+
+// flakyStorage fails to read the counter failRead and to write batches while failWrites is set.
+type flakyStorage struct {
+	repositories.Storage
+	failRead   string
+	failWrites bool
+}
+
+func (s *flakyStorage) GetCounterMetrics(ctx context.Context, name string) (string, error) {
+	if name == s.failRead {
+		return "", errors.New("storage is down")
+	}
+	return s.Storage.GetCounterMetrics(ctx, name)
+}
+
+func (s *flakyStorage) UpdateBatchMetrics(ctx context.Context, metrics []repositories.Metrics) error {
+	if s.failWrites {
+		return errors.New("storage is down")
+	}
+	return s.Storage.UpdateBatchMetrics(ctx, metrics)
+}
+
+func TestRegistryLabelledSeries(t *testing.T) {
+	h := newTestHandler(t, "", config.ServerConfig{MaxBodySize: 1 << 20, MaxBatchSize: 1000})
+	var err error
+	h.Storager.Registry, err = registry.New([]registry.Metric{
+		{Name: "temperature", Type: "gauge", Description: "Room temperature"},
+		{Name: "errors_total", Type: "gauge"},
+	}, false)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/write", strings.NewReader("temperature,room=a value=21\nerrors_total,room=a value=3")))
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	// The series get the metadata of their family and are checked against its type.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/value/", strings.NewReader(`{"id":"temperature{room=\"a\"}","type":"gauge"}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"description":"Room temperature"`)
+
+	_, err = h.Storager.GetMetric(context.Background(), repositories.Metrics{ID: `errors_total{room="a"}`, MType: "counter"})
+	assert.True(t, errors.Is(err, repositories.ErrMetricNotFound))
+}
+
+func TestInfluxWrite(t *testing.T) {
+	h := newTestHandler(t, "", config.ServerConfig{MaxBodySize: 1 << 20, MaxBatchSize: 1000})
+
+	write := func(query, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/write"+query, strings.NewReader(body)))
+		return w
+	}
+
+	w := write("?db=telegraf&precision=s", `cpu,host=a,cpu=cpu0 usage_idle=90,usage_user=5 1700000010
+cpu,host=a,cpu=cpu0 usage_idle=80 1700000000
+net,host=a,interface=eth0 bytes_total=1000i,up=true,name="eth0"
+temperature value=21.5
+`)
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	assert.Equal(t, 90.0, *h.get("gauge", `cpu_usage_idle{cpu="cpu0",host="a"}`).Value)
+	assert.Equal(t, 5.0, *h.get("gauge", `cpu_usage_user{cpu="cpu0",host="a"}`).Value)
+	assert.Equal(t, int64(1000), *h.get("counter", `net_bytes_total{host="a",interface="eth0"}`).Delta)
+	assert.Equal(t, 1.0, *h.get("gauge", `net_up{host="a",interface="eth0"}`).Value)
+	assert.Equal(t, 21.5, *h.get("gauge", "temperature").Value)
+	_, err := h.Storager.GetMetric(context.Background(), repositories.Metrics{ID: `net_name{host="a",interface="eth0"}`, MType: "gauge"})
+	assert.True(t, errors.Is(err, repositories.ErrMetricNotFound))
+
+	// Counters follow the cumulative value.
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, err = zw.Write([]byte("net,host=a,interface=eth0 bytes_total=1500i\n"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	r := httptest.NewRequest(http.MethodPost, "/write", &gz)
+	r.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, int64(1500), *h.get("counter", `net_bytes_total{host="a",interface="eth0"}`).Delta)
+
+	w = write("", "cpu usage_idle=90\ncpu usage_idle")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"error":"line 2: missing value of field usage_idle"}`, w.Body.String())
+
+	w = write("?precision=d", "cpu usage_idle=90")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// InfluxDB 1.x clients send the key as the password.
+	h.Storager.Key = "secret"
+	assert.Equal(t, http.StatusUnauthorized, write("?u=telegraf&p=wrong", "temperature value=1").Code)
+	assert.Equal(t, http.StatusNoContent, write("?u=telegraf&p=secret", "temperature value=1").Code)
+
+	r = httptest.NewRequest(http.MethodPost, "/write", strings.NewReader("temperature value=2"))
+	r.SetBasicAuth("telegraf", "secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, 2.0, *h.get("gauge", "temperature").Value)
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	h := newTestHandler(t, "", config.ServerConfig{MaxBodySize: 1 << 20, MaxBatchSize: 1000})
+
+	export := func(contentType string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	host := []otlp.Attribute{{Key: "host", Value: "a"}}
+	req := otlp.Request{Resources: []otlp.ResourceMetrics{{
+		Attributes: []otlp.Attribute{{Key: "service.name", Value: "api"}},
+		Metrics: []otlp.Metric{
+			{Name: "temperature", Kind: otlp.KindGauge, Numbers: []otlp.NumberPoint{
+				{Attributes: host, Time: 2, Value: 21.5},
+				{Attributes: host, Time: 1, Value: 19},
+			}},
+			{Name: "requests_total", Kind: otlp.KindSum, Temporality: otlp.TemporalityCumulative, Monotonic: true,
+				Numbers: []otlp.NumberPoint{{Attributes: host, Time: 1, Value: 100}}},
+			{Name: "queue_size", Kind: otlp.KindSum, Temporality: otlp.TemporalityCumulative,
+				Numbers: []otlp.NumberPoint{{Attributes: host, Time: 1, Value: -3}}},
+			{Name: "latency", Kind: otlp.KindHistogram, Temporality: otlp.TemporalityCumulative,
+				Histograms: []otlp.HistogramPoint{{Attributes: host, Time: 1, Count: 6, Sum: 2.5,
+					BucketCounts: []uint64{4, 2}, ExplicitBounds: []float64{0.5}}}},
+			{Name: "summary", Kind: otlp.KindUnsupported},
+		},
+	}}}
+
+	w := export("application/x-protobuf", otlptest.MarshalProto(req))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "application/x-protobuf", w.Header().Get("Content-Type"))
+
+	assert.Equal(t, 21.5, *h.get("gauge", `temperature{host="a",job="api"}`).Value)
+	assert.Equal(t, int64(100), *h.get("counter", `requests_total{host="a",job="api"}`).Delta)
+	assert.Equal(t, -3.0, *h.get("gauge", `queue_size{host="a",job="api"}`).Value)
+	assert.Equal(t, int64(6), *h.get("counter", `latency_count{host="a",job="api"}`).Delta)
+	assert.Equal(t, 2.5, *h.get("gauge", `latency_sum{host="a",job="api"}`).Value)
+	assert.Equal(t, int64(4), *h.get("counter", `latency_bucket{host="a",job="api",le="0.5"}`).Delta)
+	assert.Equal(t, int64(6), *h.get("counter", `latency_bucket{host="a",job="api",le="+Inf"}`).Delta)
+
+	// Cumulative sums follow the reported total, delta sums are added.
+	w = export("application/json", []byte(`{"resourceMetrics":[{
+		"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}}]},
+		"scopeMetrics":[{"metrics":[
+			{"name":"requests_total","sum":{"aggregationTemporality":2,"isMonotonic":true,
+				"dataPoints":[{"attributes":[{"key":"host","value":{"stringValue":"a"}}],"timeUnixNano":"2","asInt":"150"}]}},
+			{"name":"jobs_total","sum":{"aggregationTemporality":1,"isMonotonic":true,
+				"dataPoints":[{"timeUnixNano":"2","asDouble":2},{"timeUnixNano":"3","asDouble":3}]}}
+		]}]}]}`))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{}`, w.Body.String())
+	assert.Equal(t, int64(150), *h.get("counter", `requests_total{host="a",job="api"}`).Delta)
+	assert.Equal(t, int64(5), *h.get("counter", `jobs_total{job="api"}`).Delta)
+
+	w = export("application/json", []byte(`{"resourceMetrics":[`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	w = export("text/plain", []byte("temperature 21.5"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/lineprotocol"
+	"github.com/fkocharli/metricity/internal/repositories"
+)
+
+// influxWrite accepts InfluxDB line protocol as sent to the 1.x write API, e.g. by the
+// Telegraf influxdb output. Every numeric or boolean field becomes a series named
+// measurement_field (just measurement for a field called "value") labelled with the
+// tags, see seriesID. Series named like counters (_total, _count, _bucket) are stored
+// as counters following the cumulative value, see cumulativeCounter, others as gauges.
+// String fields are ignored. Only the latest point of every series is written.
+func (s *ServerHandlers) influxWrite(w http.ResponseWriter, r *http.Request) {
+	precision, err := lineprotocol.ParsePrecision(r.URL.Query().Get("precision"))
+	if err != nil {
+		influxError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		influxError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	points, err := lineprotocol.Parse(string(body), precision)
+	if err != nil {
+		log.Printf("Unable to parse line protocol. Error: %v", err)
+		influxError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	updates := s.counters.begin()
+	metrics, err := s.influxMetrics(r.Context(), updates, points)
+	if err != nil {
+		updates.undoAll()
+		w.WriteHeader(storageErrorStatus(err))
+		return
+	}
+
+	if _, err := s.ingest(r.Context(), updates, metrics); err != nil {
+		log.Println(err)
+		w.WriteHeader(storageErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *ServerHandlers) influxMetrics(ctx context.Context, updates *counterUpdates, points []lineprotocol.Point) ([]repositories.Metrics, error) {
+	type sample struct {
+		counter bool
+		value   float64
+		time    time.Time
+	}
+
+	now := time.Now()
+	var ids []string
+	latest := make(map[string]sample)
+	for _, p := range points {
+		tags := make(map[string]string, len(p.Tags))
+		for _, t := range p.Tags {
+			tags[t.Key] = t.Value
+		}
+		if p.Time.IsZero() {
+			p.Time = now
+		}
+
+		for _, f := range p.Fields {
+			var v float64
+			switch x := f.Value.(type) {
+			case float64:
+				v = x
+			case int64:
+				v = float64(x)
+			case uint64:
+				v = float64(x)
+			case bool:
+				if x {
+					v = 1
+				}
+			default:
+				continue
+			}
+
+			name := p.Measurement
+			if f.Key != "value" {
+				name += "_" + f.Key
+			}
+			id := seriesID(name, tags)
+
+			old, ok := latest[id]
+			if ok && old.time.After(p.Time) {
+				continue
+			}
+			if !ok {
+				ids = append(ids, id)
+			}
+			_, isBool := f.Value.(bool)
+			latest[id] = sample{counter: !isBool && hasCounterSuffix(name), value: v, time: p.Time}
+		}
+	}
+
+	metrics := make([]repositories.Metrics, 0, len(ids))
+	for _, id := range ids {
+		smp := latest[id]
+		if !smp.counter {
+			v := smp.value
+			metrics = append(metrics, repositories.Metrics{ID: id, MType: "gauge", Value: &v})
+			continue
+		}
+
+		m, err := s.cumulativeCounter(ctx, updates, id, smp.value, 0)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+
+	return metrics, nil
+}
+
+// influxError responds the way the InfluxDB 1.x API does, so clients log the reason.
+func influxError(w http.ResponseWriter, msg string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": msg}); err != nil {
+		log.Println(err)
+	}
+}
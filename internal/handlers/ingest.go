@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+)
+
+// ingest writes metrics converted from third-party formats in best-effort batches
+// of at most MaxBatchSize. The senders were authorized by requireKey, so there are
+// no hashes to check. The counter changes of the metrics that aren't stored are
+// undone. It returns the number of rejected metrics.
+func (s *ServerHandlers) ingest(ctx context.Context, updates *counterUpdates, metrics []repositories.Metrics) (int, error) {
+	size := s.MaxBatchSize
+	if size <= 0 {
+		size = len(metrics)
+	}
+
+	rejected := 0
+	for start := 0; start < len(metrics); start += size {
+		end := start + size
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+
+		res, err := s.Storager.UpdateTrustedBatchMetrics(ctx, metrics[start:end], repositories.BatchBestEffort)
+		if err != nil {
+			updates.undo(metrics[start:])
+			return rejected, err
+		}
+		for _, item := range res.Rejected {
+			log.Printf("Rejected %s %s: %s", item.MType, item.ID, item.Error)
+			updates.undo([]repositories.Metrics{{ID: item.ID, MType: item.MType}})
+		}
+		rejected += len(res.Rejected)
+	}
+
+	return rejected, nil
+}
+
+// seriesID names a labelled series in Prometheus notation with the labels sorted
+// by name, e.g. http_requests_total{code="200",method="GET"}.
+func seriesID(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[k]))
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+// counterSeries remembers the last cumulative value each source counter reported,
+// so the next one can be turned into an increment of the stored counter, and the
+// rounding remainders of delta counters.
+type counterSeries struct {
+	mu         sync.Mutex
+	series     map[string]counterState
+	remainders map[string]float64
+}
+
+type counterState struct {
+	last  float64
+	start uint64
+}
+
+func newCounterSeries() *counterSeries {
+	return &counterSeries{
+		series:     make(map[string]counterState),
+		remainders: make(map[string]float64),
+	}
+}
+
+// begin starts recording the changes a request makes to the counter state.
+func (c *counterSeries) begin() *counterUpdates {
+	return &counterUpdates{counters: c, changes: make(map[string]*counterChange)}
+}
+
+// counterUpdates records how the counters of one request changed the state, so the
+// changes can be undone for the increments that don't get stored. Otherwise the
+// next value would be compared against a state the stored total never reached.
+type counterUpdates struct {
+	counters *counterSeries
+	changes  map[string]*counterChange
+}
+
+type counterChange struct {
+	delta bool
+	// prev is the state of a cumulative series before the request, known tells
+	// whether there was one, set is the state the request left.
+	prev  counterState
+	known bool
+	set   counterState
+	// carried is what the request added to the remainder of a delta series.
+	carried float64
+}
+
+// change returns the change of the series, recording its current state the first
+// time the request touches it. The caller holds the lock.
+func (u *counterUpdates) change(id string, delta bool) *counterChange {
+	ch, ok := u.changes[id]
+	if !ok {
+		ch = &counterChange{delta: delta}
+		ch.prev, ch.known = u.counters.series[id]
+		u.changes[id] = ch
+	}
+	return ch
+}
+
+// undo reverts the changes made for the given counters. A cumulative series another
+// request moved on from since is forgotten instead, so its next value is compared
+// against the stored total again.
+func (u *counterUpdates) undo(metrics []repositories.Metrics) {
+	c := u.counters
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, m := range metrics {
+		ch, ok := u.changes[m.ID]
+		if m.MType != "counter" || !ok {
+			continue
+		}
+		delete(u.changes, m.ID)
+
+		if ch.delta {
+			c.remainders[m.ID] -= ch.carried
+			continue
+		}
+		if cur, ok := c.series[m.ID]; ok && ch.known && cur == ch.set {
+			c.series[m.ID] = ch.prev
+		} else {
+			delete(c.series, m.ID)
+		}
+	}
+}
+
+// undoAll reverts every change of the request.
+func (u *counterUpdates) undoAll() {
+	metrics := make([]repositories.Metrics, 0, len(u.changes))
+	for id := range u.changes {
+		metrics = append(metrics, repositories.Metrics{ID: id, MType: "counter"})
+	}
+	u.undo(metrics)
+}
+
+// deltaCounter rounds the increment reported by a delta counter to an integer and
+// carries the rest over to the next increment of the series, so fractions add up
+// instead of being rounded away on every export.
+func (u *counterUpdates) deltaCounter(id string, value float64) int64 {
+	c := u.counters
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v := value + c.remainders[id]
+	d := math.Round(v)
+	c.remainders[id] = v - d
+	u.change(id, true).carried += value - d
+	return int64(d)
+}
+
+// cumulativeCounter turns the cumulative value of a counter in a source system into an
+// update of the stored counter: the difference to the last value of the series, or the
+// whole value after a reset in the source, seen as a decrease or, when the source
+// reports one, as a new start time. Values are rounded to integers. The first value of
+// a series since startup continues from the stored total. Concurrent requests for the
+// same series each get their own difference, so every increment is counted once.
+func (s *ServerHandlers) cumulativeCounter(ctx context.Context, u *counterUpdates, id string, value float64, start uint64) (repositories.Metrics, error) {
+	c := u.counters
+	total := int64(math.Round(value))
+
+	var (
+		stored *int64
+		read   bool
+	)
+	for {
+		c.mu.Lock()
+		last, ok := c.series[id]
+		if ok || read {
+			delta := total
+			switch {
+			case !ok:
+				if stored != nil && *stored <= total {
+					delta = total - *stored
+				}
+			case value >= last.last && start == last.start:
+				delta = total - int64(math.Round(last.last))
+			}
+
+			state := counterState{last: value, start: start}
+			u.change(id, false).set = state
+			c.series[id] = state
+			c.mu.Unlock()
+			return repositories.Metrics{ID: id, MType: "counter", Delta: &delta}, nil
+		}
+		c.mu.Unlock()
+
+		// The stored total is read without holding the lock, so other series don't
+		// wait for storage. The state is looked at again once it's there.
+		m, err := s.Storager.GetMetric(ctx, repositories.Metrics{ID: id, MType: "counter"})
+		switch {
+		case err == nil:
+			stored = m.Delta
+		case !errors.Is(err, repositories.ErrMetricNotFound):
+			return repositories.Metrics{}, err
+		}
+		read = true
+	}
+}
+
+// seriesLocks serialises updates of single series that read the stored value first.
+type seriesLocks struct {
+	mu    sync.Mutex
+	locks map[string]*seriesLock
+}
+
+type seriesLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock locks the series in a fixed order, so requests locking several can't deadlock,
+// and returns the function unlocking them.
+func (l *seriesLocks) lock(ids []string) func() {
+	if len(ids) == 0 {
+		return func() {}
+	}
+
+	ids = append([]string(nil), ids...)
+	sort.Strings(ids)
+
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*seriesLock)
+	}
+	held := make([]*seriesLock, len(ids))
+	for i, id := range ids {
+		sl, ok := l.locks[id]
+		if !ok {
+			sl = &seriesLock{}
+			l.locks[id] = sl
+		}
+		sl.refs++
+		held[i] = sl
+	}
+	l.mu.Unlock()
+
+	for _, sl := range held {
+		sl.mu.Lock()
+	}
+
+	return func() {
+		for _, sl := range held {
+			sl.mu.Unlock()
+		}
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i, sl := range held {
+			if sl.refs--; sl.refs == 0 {
+				delete(l.locks, ids[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// limitBody caps the size of the request body. Reading past the limit
+// makes the decoder fail with *http.MaxBytesError which is reported as 413.
+func (s *ServerHandlers) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.MaxBodySize > 0 {
+			if r.ContentLength > s.MaxBodySize {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decompressBody decodes gzip request bodies. limitBody bounds the compressed size,
+// the decompressed body is capped at MaxBodySize as well. A malformed gzip stream
+// surfaces as a read error, so handlers report it in their own format.
+func (s *ServerHandlers) decompressBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			r.Body = &gzipBody{body: r.Body}
+			if s.MaxBodySize > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+			}
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = -1
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gzipBody reads the gzip header on the first Read.
+type gzipBody struct {
+	body io.ReadCloser
+	gz   *gzip.Reader
+	err  error
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.gz == nil && b.err == nil {
+		b.gz, b.err = gzip.NewReader(b.body)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.gz.Read(p)
+}
+
+func (b *gzipBody) Close() error {
+	if b.gz != nil {
+		b.gz.Close()
+	}
+	return b.body.Close()
+}
+
+// rateLimit rejects requests of clients that exhausted their token bucket with 429.
+func (s *ServerHandlers) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ok, wait := s.Limiter.Allow(clientKey(r))
+		if !ok {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireKey guards ingestion endpoints for third-party formats, which can't carry
+// per-metric hashes. When the server has a key, the client must present it as
+// "Authorization: Bearer <key>" or, as Telegraf sends it, "Token <key>", or the way
+// InfluxDB 1.x clients do, as the basic auth password or the p query parameter.
+func (s *ServerHandlers) requireKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Storager.Key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(requestKey(r)), []byte(s.Storager.Key)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestKey returns the key presented by the client, empty if there is none.
+func requestKey(r *http.Request) string {
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+
+	auth := r.Header.Get("Authorization")
+	for _, scheme := range []string{"Bearer ", "Token "} {
+		if strings.HasPrefix(auth, scheme) {
+			return strings.TrimPrefix(auth, scheme)
+		}
+	}
+
+	return r.URL.Query().Get("p")
+}
+
+// clientKey identifies the sender by its IP address. Headers the client picks itself,
+// like X-Agent-ID, would let it start over with a fresh bucket on every request.
+func clientKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// realIP takes the client address from X-Forwarded-For or X-Real-IP, but only when
+// the connection comes from one of TrustedProxies. Anybody else could claim any
+// address, so their requests keep the address of the connection.
+func (s *ServerHandlers) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.TrustedProxies) > 0 && s.trusted(remoteIP(r.RemoteAddr)) {
+			if ip := s.forwardedIP(r); ip != nil {
+				r.RemoteAddr = ip.String()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedIP returns the last address in X-Forwarded-For that isn't a trusted
+// proxy, as the ones before it were added by the client, or else X-Real-IP.
+func (s *ServerHandlers) forwardedIP(r *http.Request) net.IP {
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+
+	var ip net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		if ip = hop; !s.trusted(ip) {
+			return ip
+		}
+	}
+	if ip != nil {
+		return ip
+	}
+
+	return net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+}
+
+func (s *ServerHandlers) trusted(ip net.IP) bool {
+	for _, network := range s.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+// ParseTrustedProxies parses the addresses of trusted proxies given as IPs or CIDR networks.
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", p)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", p, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
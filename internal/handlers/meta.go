@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/fkocharli/metricity/internal/registry"
+	"github.com/fkocharli/metricity/internal/repositories"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// valueResponse is a metric value together with its registry entry, if any.
+type valueResponse struct {
+	repositories.Metrics
+	Meta *registry.Metric `json:"meta,omitempty"`
+}
+
+func (s *ServerHandlers) metaFor(name string) *registry.Metric {
+	m, ok := s.Storager.Registry.Lookup(name)
+	if !ok {
+		return nil
+	}
+	return &m
+}
+
+func (s *ServerHandlers) getMeta(w http.ResponseWriter, r *http.Request) {
+	m := s.metaFor(chi.URLParam(r, "metricname"))
+	if m == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		log.Println(err)
+	}
+}
+
+// putMeta registers the metric or replaces its metadata. The name is taken from the path.
+func (s *ServerHandlers) putMeta(w http.ResponseWriter, r *http.Request) {
+	if s.Storager.Registry == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	var m registry.Metric
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		log.Println(err)
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	m.Name = chi.URLParam(r, "metricname")
+
+	if err := s.Storager.Registry.Set(m); err != nil {
+		log.Printf("Unable to update metric metadata. Error: %v", err)
+		if errors.Is(err, registry.ErrInvalidEntry) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *ServerHandlers) deleteMeta(w http.ResponseWriter, r *http.Request) {
+	if s.Storager.Registry == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err := s.Storager.Registry.Delete(chi.URLParam(r, "metricname"))
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case registry.ErrUnknownMetric:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		log.Printf("Unable to delete metric metadata. Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
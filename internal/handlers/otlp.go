@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/fkocharli/metricity/internal/otlp"
+	"github.com/fkocharli/metricity/internal/repositories"
+)
+
+// grpcInvalidArgument is the google.rpc.Code of malformed OTLP requests.
+const grpcInvalidArgument = 3
+
+// otlpSample is the value a series gets from one export. Delta values are added
+// to what is stored, cumulative ones replace it, see cumulativeCounter for counters.
+type otlpSample struct {
+	mtype string
+	id    string
+	delta bool
+	value float64
+	start uint64
+	time  uint64
+}
+
+// otlpBatch collects the series of an export, keeping the latest cumulative value
+// and the sum of the delta values of each.
+type otlpBatch struct {
+	keys    []string
+	samples map[string]*otlpSample
+	// deltaGauges are the gauges whose values are added to the stored ones.
+	deltaGauges []string
+}
+
+func (b *otlpBatch) add(mtype, id string, delta bool, value float64, start, t uint64) {
+	key := mtype + ":" + id
+	old, ok := b.samples[key]
+	switch {
+	case !ok:
+		if delta && mtype == "gauge" {
+			b.deltaGauges = append(b.deltaGauges, id)
+		}
+		b.keys = append(b.keys, key)
+		b.samples[key] = &otlpSample{mtype: mtype, id: id, delta: delta, value: value, start: start, time: t}
+	case delta:
+		old.value += value
+	case t >= old.time:
+		old.value, old.start, old.time = value, start, t
+	}
+}
+
+// otlpMetrics receives OTLP/HTTP metric exports in protobuf or JSON. Data points are
+// stored as series named after the metric and labelled with their attributes plus
+// job and instance taken from the service.namespace, service.name and
+// service.instance.id resource attributes, see seriesID. Gauges and non-monotonic
+// sums are gauges, monotonic sums counters. Histograms are split the Prometheus way
+// into cumulative name_bucket{le="..."} and name_count counters and a name_sum gauge.
+// Other metric kinds are reported back as rejected.
+func (s *ServerHandlers) otlpMetrics(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	asJSON := mediaType == "application/json"
+	if !asJSON && mediaType != "application/x-protobuf" && mediaType != "" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		otlpError(w, err.Error(), asJSON)
+		return
+	}
+	defer r.Body.Close()
+
+	var req otlp.Request
+	if asJSON {
+		req, err = otlp.UnmarshalJSON(body)
+	} else {
+		req, err = otlp.UnmarshalProto(body)
+	}
+	if err != nil {
+		log.Printf("Unable to decode OTLP request. Error: %v", err)
+		otlpError(w, err.Error(), asJSON)
+		return
+	}
+
+	batch, unsupported := otlpSeries(req)
+	// Delta gauges are read, added to and written back: exports updating the same
+	// ones can't overlap.
+	defer s.deltaGauges.lock(batch.deltaGauges)()
+	updates := s.counters.begin()
+	metrics, err := s.otlpResolve(r.Context(), updates, batch)
+	if err != nil {
+		updates.undoAll()
+		w.WriteHeader(storageErrorStatus(err))
+		return
+	}
+
+	rejected, err := s.ingest(r.Context(), updates, metrics)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(storageErrorStatus(err))
+		return
+	}
+
+	var msg string
+	if rejected+unsupported > 0 {
+		msg = fmt.Sprintf("%d series rejected, %d metrics of unsupported kinds", rejected, unsupported)
+	}
+
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(otlp.MarshalResponse(int64(rejected+unsupported), msg, asJSON)); err != nil {
+		log.Println(err)
+	}
+}
+
+// otlpSeries maps the data points of the request to series. It also returns the
+// number of metrics of kinds that aren't supported.
+func otlpSeries(req otlp.Request) (*otlpBatch, int) {
+	batch := &otlpBatch{samples: make(map[string]*otlpSample)}
+	unsupported := 0
+
+	for _, rm := range req.Resources {
+		resource := make(map[string]string)
+		var namespace, service string
+		for _, a := range rm.Attributes {
+			switch a.Key {
+			case "service.namespace":
+				namespace = a.Value
+			case "service.name":
+				service = a.Value
+			case "service.instance.id":
+				resource["instance"] = a.Value
+			}
+		}
+		switch {
+		case namespace != "" && service != "":
+			resource["job"] = namespace + "/" + service
+		case service != "":
+			resource["job"] = service
+		}
+
+		labels := func(attrs []otlp.Attribute) map[string]string {
+			res := make(map[string]string, len(resource)+len(attrs))
+			for k, v := range resource {
+				res[k] = v
+			}
+			for _, a := range attrs {
+				res[a.Key] = a.Value
+			}
+			return res
+		}
+
+		for _, m := range rm.Metrics {
+			delta := m.Temporality == otlp.TemporalityDelta
+
+			switch m.Kind {
+			case otlp.KindGauge, otlp.KindSum:
+				mtype := "gauge"
+				if m.Kind == otlp.KindSum && m.Monotonic {
+					mtype = "counter"
+				}
+				for _, p := range m.Numbers {
+					if p.NoValue || math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+						continue
+					}
+					batch.add(mtype, seriesID(m.Name, labels(p.Attributes)), delta && m.Kind == otlp.KindSum, p.Value, p.StartTime, p.Time)
+				}
+
+			case otlp.KindHistogram:
+				for _, p := range m.Histograms {
+					if p.NoValue {
+						continue
+					}
+					l := labels(p.Attributes)
+					batch.add("counter", seriesID(m.Name+"_count", l), delta, float64(p.Count), p.StartTime, p.Time)
+					if !math.IsNaN(p.Sum) && !math.IsInf(p.Sum, 0) {
+						batch.add("gauge", seriesID(m.Name+"_sum", l), delta, p.Sum, p.StartTime, p.Time)
+					}
+
+					var cumulative uint64
+					for i, c := range p.BucketCounts {
+						cumulative += c
+						le := "+Inf"
+						if i < len(p.ExplicitBounds) {
+							le = strconv.FormatFloat(p.ExplicitBounds[i], 'g', -1, 64)
+						}
+						bucket := labels(p.Attributes)
+						bucket["le"] = le
+						batch.add("counter", seriesID(m.Name+"_bucket", bucket), delta, float64(cumulative), p.StartTime, p.Time)
+					}
+				}
+
+			default:
+				unsupported++
+			}
+		}
+	}
+
+	return batch, unsupported
+}
+
+func (s *ServerHandlers) otlpResolve(ctx context.Context, updates *counterUpdates, batch *otlpBatch) ([]repositories.Metrics, error) {
+	metrics := make([]repositories.Metrics, 0, len(batch.keys))
+	for _, key := range batch.keys {
+		smp := batch.samples[key]
+
+		switch {
+		case smp.mtype == "counter" && smp.delta:
+			d := updates.deltaCounter(smp.id, smp.value)
+			metrics = append(metrics, repositories.Metrics{ID: smp.id, MType: "counter", Delta: &d})
+
+		case smp.mtype == "counter":
+			m, err := s.cumulativeCounter(ctx, updates, smp.id, smp.value, smp.start)
+			if err != nil {
+				return nil, err
+			}
+			metrics = append(metrics, m)
+
+		case smp.delta:
+			v := smp.value
+			m, err := s.Storager.GetMetric(ctx, repositories.Metrics{ID: smp.id, MType: "gauge"})
+			switch {
+			case err == nil:
+				v += *m.Value
+			case !errors.Is(err, repositories.ErrMetricNotFound):
+				return nil, err
+			}
+			metrics = append(metrics, repositories.Metrics{ID: smp.id, MType: "gauge", Value: &v})
+
+		default:
+			v := smp.value
+			metrics = append(metrics, repositories.Metrics{ID: smp.id, MType: "gauge", Value: &v})
+		}
+	}
+
+	return metrics, nil
+}
+
+// otlpError responds with a google.rpc.Status in the encoding of the request.
+func otlpError(w http.ResponseWriter, msg string, asJSON bool) {
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	if _, err := w.Write(otlp.MarshalStatus(grpcInvalidArgument, msg, asJSON)); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/fkocharli/metricity/internal/prompb"
+	"github.com/fkocharli/metricity/internal/repositories"
+)
+
+// maxDecodedRatio bounds the size of a decompressed remote_write request relative to MaxBodySize.
+const maxDecodedRatio = 16
+
+// familyTypes remembers the metric family types Prometheus sends in the metadata of
+// remote_write requests, which usually come separately from the samples.
+type familyTypes struct {
+	Mutex *sync.RWMutex
+	types map[string]prompb.MetricType
+}
+
+func newFamilyTypes() *familyTypes {
+	return &familyTypes{
+		Mutex: &sync.RWMutex{},
+		types: make(map[string]prompb.MetricType),
+	}
+}
+
+func (f *familyTypes) set(metadata []prompb.MetricMetadata) {
+	if len(metadata) == 0 {
+		return
+	}
+
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+
+	for _, md := range metadata {
+		f.types[md.FamilyName] = md.Type
+	}
+}
+
+func (f *familyTypes) lookup(name string) (prompb.MetricType, bool) {
+	f.Mutex.RLock()
+	defer f.Mutex.RUnlock()
+
+	t, ok := f.types[name]
+	return t, ok
+}
+
+// isCounter tells whether the series is cumulative and belongs in a counter. Without
+// metadata the Prometheus naming conventions decide: _total, _count and _bucket are counters.
+func (f *familyTypes) isCounter(name string) bool {
+	if t, ok := f.lookup(name); ok {
+		return t == prompb.Counter
+	}
+
+	for _, suffix := range []string{"_total", "_bucket", "_count", "_sum"} {
+		family := strings.TrimSuffix(name, suffix)
+		if family == name {
+			continue
+		}
+		if t, ok := f.lookup(family); ok {
+			switch t {
+			case prompb.Counter:
+				return suffix == "_total"
+			case prompb.Histogram, prompb.Summary:
+				return suffix != "_sum"
+			}
+			return false
+		}
+	}
+
+	return hasCounterSuffix(name)
+}
+
+func hasCounterSuffix(name string) bool {
+	return strings.HasSuffix(name, "_total") || strings.HasSuffix(name, "_count") || strings.HasSuffix(name, "_bucket")
+}
+
+// promWrite accepts Prometheus remote_write requests. Every series is stored under its
+// name followed by its labels sorted by name, e.g. http_requests_total{code="200"},
+// using its latest sample. Gauges take the sample value, counters follow the cumulative
+// value as described at cumulativeCounter.
+func (s *ServerHandlers) promWrite(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	req, err := prompb.Decode(body, int(s.MaxBodySize*maxDecodedRatio))
+	if err != nil {
+		log.Printf("Unable to decode remote write request. Error: %v", err)
+		if err == prompb.ErrTooLarge {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.promFamilies.set(req.Metadata)
+
+	updates := s.counters.begin()
+	metrics, err := s.promMetrics(r.Context(), updates, req.Timeseries)
+	if err != nil {
+		updates.undoAll()
+		w.WriteHeader(storageErrorStatus(err))
+		return
+	}
+
+	if _, err := s.ingest(r.Context(), updates, metrics); err != nil {
+		log.Println(err)
+		w.WriteHeader(storageErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *ServerHandlers) promMetrics(ctx context.Context, updates *counterUpdates, series []prompb.TimeSeries) ([]repositories.Metrics, error) {
+	metrics := make([]repositories.Metrics, 0, len(series))
+	for _, ts := range series {
+		name, id := promSeriesID(ts.Labels)
+		sample, ok := latestSample(ts.Samples)
+		if name == "" || !ok {
+			continue
+		}
+
+		if !s.promFamilies.isCounter(name) {
+			v := sample.Value
+			metrics = append(metrics, repositories.Metrics{ID: id, MType: "gauge", Value: &v})
+			continue
+		}
+
+		m, err := s.cumulativeCounter(ctx, updates, id, sample.Value, 0)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+
+	return metrics, nil
+}
+
+// promSeriesID returns the metric name and the series ID.
+func promSeriesID(labels []prompb.Label) (string, string) {
+	var name string
+	rest := make(map[string]string, len(labels))
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			name = l.Value
+			continue
+		}
+		rest[l.Name] = l.Value
+	}
+	return name, seriesID(name, rest)
+}
+
+// latestSample skips NaN and infinite values, which include Prometheus staleness markers.
+func latestSample(samples []prompb.Sample) (prompb.Sample, bool) {
+	var (
+		latest prompb.Sample
+		found  bool
+	)
+	for _, sample := range samples {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+		if !found || sample.Timestamp >= latest.Timestamp {
+			latest, found = sample, true
+		}
+	}
+	return latest, found
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+)
+
+const (
+	streamBuffer    = 256
+	streamHeartbeat = 15 * time.Second
+)
+
+// stream pushes accepted metric updates as Server-Sent Events ("metric" events with
+// the metric as JSON). The prefix and type query parameters narrow down the metrics.
+func (s *ServerHandlers) stream(w http.ResponseWriter, r *http.Request) {
+	if s.Storager.Broker == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	filter := repositories.Filter{
+		Prefix: r.URL.Query().Get("prefix"),
+		Type:   r.URL.Query().Get("type"),
+	}
+	switch filter.Type {
+	case "", "gauge", "counter":
+	default:
+		http.Error(w, repositories.ErrUndefinedMetricType.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("Streaming is not supported by the response writer")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	sub := s.Storager.Broker.Subscribe(filter, streamBuffer)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case m, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(m)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: metric\ndata: %s\n\n", b); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
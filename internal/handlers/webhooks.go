@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/fkocharli/metricity/internal/webhooks"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// subscriptionResponse is a webhook subscription without its secret.
+type subscriptionResponse struct {
+	webhooks.Subscription
+	Signed bool `json:"signed"`
+}
+
+func newSubscriptionResponse(sub webhooks.Subscription) subscriptionResponse {
+	signed := sub.Secret != ""
+	sub.Secret = ""
+	return subscriptionResponse{Subscription: sub, Signed: signed}
+}
+
+func (s *ServerHandlers) addWebhook(w http.ResponseWriter, r *http.Request) {
+	if s.Webhooks == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	var sub webhooks.Subscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		log.Println(err)
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	sub, err := s.Webhooks.Add(sub)
+	if err != nil {
+		log.Printf("Unable to add webhook subscription. Error: %v", err)
+		if errors.Is(err, webhooks.ErrInvalidSubscription) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(newSubscriptionResponse(sub)); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *ServerHandlers) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	if s.Webhooks == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	subs := s.Webhooks.All()
+	res := make([]subscriptionResponse, 0, len(subs))
+	for _, sub := range subs {
+		res = append(res, newSubscriptionResponse(sub))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *ServerHandlers) getWebhook(w http.ResponseWriter, r *http.Request) {
+	if s.Webhooks == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	sub, ok := s.Webhooks.Get(chi.URLParam(r, "id"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(newSubscriptionResponse(sub)); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *ServerHandlers) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if s.Webhooks == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err := s.Webhooks.Delete(chi.URLParam(r, "id"))
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case webhooks.ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		log.Printf("Unable to delete webhook subscription. Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,236 @@
+// Package lineprotocol parses the InfluxDB line protocol:
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+package lineprotocol
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrUnknownPrecision = errors.New("unknown timestamp precision")
+
+// ParseError reports the first malformed line of the input.
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Field holds one value of a point: float64, int64 (12i), uint64 (12u), string or bool.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Point is one line. Time is zero when the line has no timestamp.
+type Point struct {
+	Measurement string
+	Tags        []Tag
+	Fields      []Field
+	Time        time.Time
+}
+
+// ParsePrecision maps the precision query parameter of the write API, in both its
+// InfluxDB 1.x (n, u, ms, s, m, h) and 2.x (ns, us, ms, s) spellings, to a duration.
+// An empty value means nanoseconds.
+func ParsePrecision(s string) (time.Duration, error) {
+	switch s {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	default:
+		return 0, ErrUnknownPrecision
+	}
+}
+
+// Parse parses every line of data, skipping empty lines and comments.
+// Timestamps are counted in units of precision since the Unix epoch.
+func Parse(data string, precision time.Duration) ([]Point, error) {
+	var points []Point
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		p, err := parseLine(line, precision)
+		if err != nil {
+			return nil, &ParseError{Line: i + 1, Msg: err.Error()}
+		}
+		points = append(points, p)
+	}
+
+	return points, nil
+}
+
+func parseLine(line string, precision time.Duration) (Point, error) {
+	var p Point
+
+	measurement, i := scan(line, 0, ", ", ", ")
+	if measurement == "" {
+		return p, errors.New("missing measurement")
+	}
+	p.Measurement = measurement
+
+	for i < len(line) && line[i] == ',' {
+		var key, value string
+		key, i = scan(line, i+1, "=", ",= ")
+		if key == "" {
+			return p, errors.New("missing tag key")
+		}
+		if i >= len(line) {
+			return p, fmt.Errorf("missing value of tag %s", key)
+		}
+		value, i = scan(line, i+1, ", ", ",= ")
+		if value == "" {
+			return p, fmt.Errorf("missing value of tag %s", key)
+		}
+		p.Tags = append(p.Tags, Tag{Key: key, Value: value})
+	}
+
+	if i >= len(line) || line[i] != ' ' {
+		return p, errors.New("missing fields")
+	}
+	i = skipSpaces(line, i)
+
+	for {
+		var key string
+		key, i = scan(line, i, "=", ",= ")
+		if key == "" {
+			return p, errors.New("missing field key")
+		}
+		if i >= len(line) {
+			return p, fmt.Errorf("missing value of field %s", key)
+		}
+		i++
+
+		var (
+			value interface{}
+			err   error
+		)
+		if i < len(line) && line[i] == '"' {
+			value, i, err = scanString(line, i+1)
+		} else {
+			var raw string
+			raw, i = scan(line, i, ", ", "")
+			value, err = parseValue(raw)
+		}
+		if err != nil {
+			return p, fmt.Errorf("field %s: %v", key, err)
+		}
+		p.Fields = append(p.Fields, Field{Key: key, Value: value})
+
+		if i >= len(line) || line[i] != ',' {
+			break
+		}
+		i++
+	}
+
+	if rest := strings.TrimSpace(line[i:]); rest != "" {
+		ts, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("invalid timestamp %q", rest)
+		}
+		p.Time = time.Unix(0, ts*int64(precision)).UTC()
+	}
+
+	return p, nil
+}
+
+// scan reads from i up to the first unescaped byte of stops. A backslash escapes
+// the bytes in escapable and is kept before any other byte.
+func scan(s string, i int, stops, escapable string) (string, int) {
+	var b strings.Builder
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) && strings.IndexByte(escapable, s[i+1]) >= 0 {
+			i++
+			b.WriteByte(s[i])
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), i
+}
+
+// scanString reads a string field value from after its opening quote.
+func scanString(s string, i int) (string, int, error) {
+	var b strings.Builder
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+			i++
+			b.WriteByte(s[i])
+			continue
+		}
+		if c == '"' {
+			return b.String(), i + 1, nil
+		}
+		b.WriteByte(c)
+	}
+	return "", i, errors.New("unterminated string")
+}
+
+func parseValue(raw string) (interface{}, error) {
+	switch raw {
+	case "":
+		return nil, errors.New("missing value")
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+
+	switch raw[len(raw)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %q", raw)
+		}
+		return v, nil
+	case 'u':
+		v, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unsigned integer %q", raw)
+		}
+		return v, nil
+	}
+
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, fmt.Errorf("invalid float %q", raw)
+	}
+	return v, nil
+}
+
+func skipSpaces(s string, i int) int {
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+	return i
+}
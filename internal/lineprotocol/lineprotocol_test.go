@@ -0,0 +1,79 @@
+package lineprotocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	data := `
+# Telegraf output
+cpu,host=server01,cpu=cpu-total usage_idle=92.5,usage_user=3 1700000000000000000
+mem,host=server01 used=8123456i,total=16000000000u,available_percent=49.2 1700000000000000000
+my\ measurement,tag\,key=tag\ value\=x value=1,msg="a \"quoted\" string, with spaces",ok=t
+disk  free=1e9   
+`
+	points, err := Parse(data, time.Nanosecond)
+	require.NoError(t, err)
+	require.Len(t, points, 4)
+
+	assert.Equal(t, Point{
+		Measurement: "cpu",
+		Tags:        []Tag{{Key: "host", Value: "server01"}, {Key: "cpu", Value: "cpu-total"}},
+		Fields:      []Field{{Key: "usage_idle", Value: 92.5}, {Key: "usage_user", Value: 3.0}},
+		Time:        time.Unix(1700000000, 0).UTC(),
+	}, points[0])
+
+	assert.Equal(t, []Field{
+		{Key: "used", Value: int64(8123456)},
+		{Key: "total", Value: uint64(16000000000)},
+		{Key: "available_percent", Value: 49.2},
+	}, points[1].Fields)
+
+	assert.Equal(t, "my measurement", points[2].Measurement)
+	assert.Equal(t, []Tag{{Key: "tag,key", Value: "tag value=x"}}, points[2].Tags)
+	assert.Equal(t, []Field{
+		{Key: "value", Value: 1.0},
+		{Key: "msg", Value: `a "quoted" string, with spaces`},
+		{Key: "ok", Value: true},
+	}, points[2].Fields)
+	assert.True(t, points[2].Time.IsZero())
+
+	assert.Equal(t, []Field{{Key: "free", Value: 1e9}}, points[3].Fields)
+}
+
+func TestParsePrecision(t *testing.T) {
+	precision, err := ParsePrecision("s")
+	require.NoError(t, err)
+	points, err := Parse("cpu value=1 1700000000", precision)
+	require.NoError(t, err)
+	assert.Equal(t, time.Unix(1700000000, 0).UTC(), points[0].Time)
+
+	_, err = ParsePrecision("d")
+	assert.Equal(t, ErrUnknownPrecision, err)
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, data := range []string{
+		"cpu",
+		",host=a value=1",
+		"cpu,host value=1",
+		"cpu,host= value=1",
+		"cpu value=",
+		"cpu value=1,",
+		"cpu value=abc",
+		"cpu value=NaN",
+		"cpu value=12x1i",
+		`cpu value="unterminated`,
+		"cpu value=1 yesterday",
+	} {
+		_, err := Parse("cpu value=1\n"+data, time.Nanosecond)
+		var perr *ParseError
+		if assert.ErrorAs(t, err, &perr, data) {
+			assert.Equal(t, 2, perr.Line, data)
+		}
+	}
+}
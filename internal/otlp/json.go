@@ -0,0 +1,217 @@
+package otlp
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// The OTLP/JSON encoding: protobuf JSON mapping with lowerCamelCase field names,
+// 64-bit integers usually as strings and enums as integers.
+type (
+	jsonRequest struct {
+		ResourceMetrics []jsonResourceMetrics `json:"resourceMetrics"`
+	}
+
+	jsonResourceMetrics struct {
+		Resource struct {
+			Attributes []jsonKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []struct {
+			Metrics []jsonMetric `json:"metrics"`
+		} `json:"scopeMetrics"`
+	}
+
+	jsonMetric struct {
+		Name        string    `json:"name"`
+		Description string    `json:"description"`
+		Unit        string    `json:"unit"`
+		Gauge       *jsonData `json:"gauge"`
+		Sum         *jsonData `json:"sum"`
+		Histogram   *jsonData `json:"histogram"`
+	}
+
+	jsonData struct {
+		DataPoints             []jsonPoint `json:"dataPoints"`
+		AggregationTemporality Temporality `json:"aggregationTemporality"`
+		IsMonotonic            bool        `json:"isMonotonic"`
+	}
+
+	jsonPoint struct {
+		Attributes        []jsonKeyValue `json:"attributes"`
+		StartTimeUnixNano jsonNumber     `json:"startTimeUnixNano"`
+		TimeUnixNano      jsonNumber     `json:"timeUnixNano"`
+		AsDouble          *jsonNumber    `json:"asDouble"`
+		AsInt             *jsonNumber    `json:"asInt"`
+		Count             jsonNumber     `json:"count"`
+		Sum               jsonNumber     `json:"sum"`
+		BucketCounts      []jsonNumber   `json:"bucketCounts"`
+		ExplicitBounds    []jsonNumber   `json:"explicitBounds"`
+		Flags             uint32         `json:"flags"`
+	}
+
+	jsonKeyValue struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue *string     `json:"stringValue"`
+			BoolValue   *bool       `json:"boolValue"`
+			IntValue    *jsonNumber `json:"intValue"`
+			DoubleValue *jsonNumber `json:"doubleValue"`
+		} `json:"value"`
+	}
+)
+
+// jsonNumber is a number given either as a JSON number or as a string, which is
+// how 64-bit integers and special float values like "NaN" are encoded.
+type jsonNumber string
+
+func (n *jsonNumber) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(b, []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*n = jsonNumber(s)
+		return nil
+	}
+
+	var num json.Number
+	if err := json.Unmarshal(b, &num); err != nil {
+		return err
+	}
+	*n = jsonNumber(num)
+	return nil
+}
+
+func (n jsonNumber) uint64() (uint64, error) {
+	if n == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(string(n), 10, 64)
+}
+
+func (n jsonNumber) float64() (float64, error) {
+	if n == "" {
+		return 0, nil
+	}
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		return float64(i), nil
+	}
+	return strconv.ParseFloat(string(n), 64)
+}
+
+// UnmarshalJSON parses an ExportMetricsServiceRequest in the OTLP/JSON encoding.
+func UnmarshalJSON(b []byte) (Request, error) {
+	var jr jsonRequest
+	if err := json.Unmarshal(b, &jr); err != nil {
+		return Request{}, err
+	}
+
+	var req Request
+	for _, jrm := range jr.ResourceMetrics {
+		var rm ResourceMetrics
+		rm.Attributes = jsonAttributes(jrm.Resource.Attributes)
+		for _, sm := range jrm.ScopeMetrics {
+			for _, jm := range sm.Metrics {
+				m, err := jm.metric()
+				if err != nil {
+					return Request{}, err
+				}
+				rm.Metrics = append(rm.Metrics, m)
+			}
+		}
+		req.Resources = append(req.Resources, rm)
+	}
+
+	return req, nil
+}
+
+func (jm jsonMetric) metric() (Metric, error) {
+	m := Metric{Name: jm.Name, Description: jm.Description, Unit: jm.Unit}
+
+	var data *jsonData
+	switch {
+	case jm.Gauge != nil:
+		m.Kind, data = KindGauge, jm.Gauge
+	case jm.Sum != nil:
+		m.Kind, data = KindSum, jm.Sum
+	case jm.Histogram != nil:
+		m.Kind, data = KindHistogram, jm.Histogram
+	default:
+		return m, nil
+	}
+	m.Temporality = data.AggregationTemporality
+	m.Monotonic = data.IsMonotonic
+
+	for _, jp := range data.DataPoints {
+		t, err := jp.TimeUnixNano.uint64()
+		if err != nil {
+			return m, err
+		}
+		start, err := jp.StartTimeUnixNano.uint64()
+		if err != nil {
+			return m, err
+		}
+		attrs := jsonAttributes(jp.Attributes)
+		noValue := jp.Flags&flagNoRecordedValue != 0
+
+		if m.Kind != KindHistogram {
+			p := NumberPoint{Attributes: attrs, StartTime: start, Time: t, NoValue: noValue}
+			switch {
+			case jp.AsDouble != nil:
+				p.Value, err = jp.AsDouble.float64()
+			case jp.AsInt != nil:
+				p.Value, err = jp.AsInt.float64()
+			}
+			if err != nil {
+				return m, err
+			}
+			m.Numbers = append(m.Numbers, p)
+			continue
+		}
+
+		p := HistogramPoint{Attributes: attrs, StartTime: start, Time: t, NoValue: noValue}
+		if p.Count, err = jp.Count.uint64(); err != nil {
+			return m, err
+		}
+		if p.Sum, err = jp.Sum.float64(); err != nil {
+			return m, err
+		}
+		for _, c := range jp.BucketCounts {
+			count, err := c.uint64()
+			if err != nil {
+				return m, err
+			}
+			p.BucketCounts = append(p.BucketCounts, count)
+		}
+		for _, b := range jp.ExplicitBounds {
+			bound, err := b.float64()
+			if err != nil {
+				return m, err
+			}
+			p.ExplicitBounds = append(p.ExplicitBounds, bound)
+		}
+		m.Histograms = append(m.Histograms, p)
+	}
+
+	return m, nil
+}
+
+func jsonAttributes(kvs []jsonKeyValue) []Attribute {
+	var attrs []Attribute
+	for _, kv := range kvs {
+		a := Attribute{Key: kv.Key}
+		switch v := kv.Value; {
+		case v.StringValue != nil:
+			a.Value = *v.StringValue
+		case v.BoolValue != nil:
+			a.Value = strconv.FormatBool(*v.BoolValue)
+		case v.IntValue != nil:
+			a.Value = string(*v.IntValue)
+		case v.DoubleValue != nil:
+			a.Value = string(*v.DoubleValue)
+		}
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
@@ -0,0 +1,278 @@
+// Package otlp decodes OpenTelemetry OTLP/HTTP metrics export requests in their
+// protobuf and JSON encodings. Gauge, Sum and Histogram metrics are read; other
+// kinds keep only their name and kind, and exemplars are skipped.
+package otlp
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/fkocharli/metricity/internal/pbwire"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type Kind int
+
+const (
+	KindUnsupported Kind = iota
+	KindGauge
+	KindSum
+	KindHistogram
+)
+
+type Temporality int32
+
+const (
+	TemporalityUnspecified Temporality = iota
+	TemporalityDelta
+	TemporalityCumulative
+)
+
+// flagNoRecordedValue marks a point that carries no value, e.g. after a series ended.
+const flagNoRecordedValue = 1
+
+// Attribute is a key-value pair with the value rendered as a string.
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// NumberPoint is a gauge or sum point. StartTime, when set, is when a cumulative sum
+// started counting and changes when the source resets it.
+type NumberPoint struct {
+	Attributes []Attribute
+	StartTime  uint64
+	Time       uint64
+	Value      float64
+	NoValue    bool
+}
+
+// HistogramPoint has len(ExplicitBounds)+1 BucketCounts, the last one for values above every bound.
+type HistogramPoint struct {
+	Attributes     []Attribute
+	StartTime      uint64
+	Time           uint64
+	Count          uint64
+	Sum            float64
+	BucketCounts   []uint64
+	ExplicitBounds []float64
+	NoValue        bool
+}
+
+type Metric struct {
+	Name        string
+	Description string
+	Unit        string
+	Kind        Kind
+	Temporality Temporality
+	Monotonic   bool
+	Numbers     []NumberPoint
+	Histograms  []HistogramPoint
+}
+
+type ResourceMetrics struct {
+	Attributes []Attribute
+	Metrics    []Metric
+}
+
+// Request is an ExportMetricsServiceRequest with the instrumentation scopes flattened.
+type Request struct {
+	Resources []ResourceMetrics
+}
+
+// UnmarshalProto parses a protobuf ExportMetricsServiceRequest.
+func UnmarshalProto(b []byte) (Request, error) {
+	var req Request
+	err := pbwire.Messages(b, 1, func(v []byte) error {
+		rm, err := unmarshalResourceMetrics(v)
+		req.Resources = append(req.Resources, rm)
+		return err
+	})
+
+	return req, err
+}
+
+func unmarshalResourceMetrics(b []byte) (ResourceMetrics, error) {
+	var rm ResourceMetrics
+	err := pbwire.Walk(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			return pbwire.Messages(v, 1, func(v []byte) error {
+				a, err := unmarshalAttribute(v)
+				rm.Attributes = append(rm.Attributes, a)
+				return err
+			})
+		case 2:
+			return pbwire.Messages(v, 2, func(v []byte) error {
+				m, err := unmarshalMetric(v)
+				rm.Metrics = append(rm.Metrics, m)
+				return err
+			})
+		}
+		return nil
+	})
+
+	return rm, err
+}
+
+func unmarshalMetric(b []byte) (Metric, error) {
+	var m Metric
+	err := pbwire.Walk(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			m.Name = string(v)
+		case 2:
+			m.Description = string(v)
+		case 3:
+			m.Unit = string(v)
+		case 5:
+			m.Kind = KindGauge
+			return unmarshalData(v, &m)
+		case 7:
+			m.Kind = KindSum
+			return unmarshalData(v, &m)
+		case 9:
+			m.Kind = KindHistogram
+			return unmarshalData(v, &m)
+		}
+		return nil
+	})
+
+	return m, err
+}
+
+// unmarshalData reads a Gauge, Sum or Histogram message, which share their field numbers.
+func unmarshalData(b []byte, m *Metric) error {
+	return pbwire.Walk(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			if m.Kind == KindHistogram {
+				p, err := unmarshalHistogramPoint(v)
+				m.Histograms = append(m.Histograms, p)
+				return err
+			}
+			p, err := unmarshalNumberPoint(v)
+			m.Numbers = append(m.Numbers, p)
+			return err
+		case num == 2 && typ == protowire.VarintType:
+			m.Temporality = Temporality(x)
+		case num == 3 && typ == protowire.VarintType:
+			m.Monotonic = x != 0
+		}
+		return nil
+	})
+}
+
+func unmarshalNumberPoint(b []byte) (NumberPoint, error) {
+	var p NumberPoint
+	err := pbwire.Walk(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) error {
+		switch {
+		case num == 2 && typ == protowire.Fixed64Type:
+			p.StartTime = x
+		case num == 3 && typ == protowire.Fixed64Type:
+			p.Time = x
+		case num == 4 && typ == protowire.Fixed64Type:
+			p.Value = math.Float64frombits(x)
+		case num == 6 && typ == protowire.Fixed64Type:
+			p.Value = float64(int64(x))
+		case num == 7 && typ == protowire.BytesType:
+			a, err := unmarshalAttribute(v)
+			p.Attributes = append(p.Attributes, a)
+			return err
+		case num == 8 && typ == protowire.VarintType:
+			p.NoValue = x&flagNoRecordedValue != 0
+		}
+		return nil
+	})
+
+	return p, err
+}
+
+func unmarshalHistogramPoint(b []byte) (HistogramPoint, error) {
+	var p HistogramPoint
+	err := pbwire.Walk(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) error {
+		switch {
+		case num == 2 && typ == protowire.Fixed64Type:
+			p.StartTime = x
+		case num == 3 && typ == protowire.Fixed64Type:
+			p.Time = x
+		case num == 4 && typ == protowire.Fixed64Type:
+			p.Count = x
+		case num == 5 && typ == protowire.Fixed64Type:
+			p.Sum = math.Float64frombits(x)
+		case num == 6 && typ == protowire.Fixed64Type:
+			p.BucketCounts = append(p.BucketCounts, x)
+		case num == 6 && typ == protowire.BytesType:
+			counts, err := packedFixed64(v)
+			p.BucketCounts = append(p.BucketCounts, counts...)
+			return err
+		case num == 7 && typ == protowire.Fixed64Type:
+			p.ExplicitBounds = append(p.ExplicitBounds, math.Float64frombits(x))
+		case num == 7 && typ == protowire.BytesType:
+			bounds, err := packedFixed64(v)
+			for _, bound := range bounds {
+				p.ExplicitBounds = append(p.ExplicitBounds, math.Float64frombits(bound))
+			}
+			return err
+		case num == 9 && typ == protowire.BytesType:
+			a, err := unmarshalAttribute(v)
+			p.Attributes = append(p.Attributes, a)
+			return err
+		case num == 10 && typ == protowire.VarintType:
+			p.NoValue = x&flagNoRecordedValue != 0
+		}
+		return nil
+	})
+
+	return p, err
+}
+
+func unmarshalAttribute(b []byte) (Attribute, error) {
+	var a Attribute
+	err := pbwire.Walk(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			a.Key = string(v)
+		case 2:
+			return pbwire.Walk(v, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					a.Value = string(v)
+				case num == 2 && typ == protowire.VarintType:
+					a.Value = strconv.FormatBool(x != 0)
+				case num == 3 && typ == protowire.VarintType:
+					a.Value = strconv.FormatInt(int64(x), 10)
+				case num == 4 && typ == protowire.Fixed64Type:
+					a.Value = strconv.FormatFloat(math.Float64frombits(x), 'g', -1, 64)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+
+	return a, err
+}
+
+func packedFixed64(b []byte) ([]uint64, error) {
+	var res []uint64
+	for len(b) > 0 {
+		x, n := protowire.ConsumeFixed64(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		res = append(res, x)
+		b = b[n:]
+	}
+	return res, nil
+}
@@ -0,0 +1,76 @@
+package otlp_test
+
+import (
+	"testing"
+
+	"github.com/fkocharli/metricity/internal/otlp"
+	"github.com/fkocharli/metricity/internal/otlp/otlptest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var sample = otlp.Request{
+	Resources: []otlp.ResourceMetrics{{
+		Attributes: []otlp.Attribute{{Key: "service.name", Value: "checkout"}},
+		Metrics: []otlp.Metric{
+			{
+				Name: "queue.size", Unit: "1", Kind: otlp.KindGauge,
+				Numbers: []otlp.NumberPoint{{Attributes: []otlp.Attribute{{Key: "queue", Value: "orders"}}, Time: 1700000000000000000, Value: 12}},
+			},
+			{
+				Name: "http.requests", Description: "Requests served", Kind: otlp.KindSum, Temporality: otlp.TemporalityCumulative, Monotonic: true,
+				Numbers: []otlp.NumberPoint{{StartTime: 1699999990000000000, Time: 1700000000000000000, Value: 42}, {Time: 1700000010000000000, NoValue: true}},
+			},
+			{
+				Name: "http.duration", Unit: "ms", Kind: otlp.KindHistogram, Temporality: otlp.TemporalityDelta,
+				Histograms: []otlp.HistogramPoint{{Time: 1700000000000000000, Count: 6, Sum: 250.5, BucketCounts: []uint64{1, 3, 2}, ExplicitBounds: []float64{10, 100}}},
+			},
+		},
+	}},
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	got, err := otlp.UnmarshalProto(otlptest.MarshalProto(sample))
+	require.NoError(t, err)
+	assert.Equal(t, sample, got)
+
+	_, err = otlp.UnmarshalProto([]byte{0x0a, 0x05, 0x01})
+	assert.Error(t, err)
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	got, err := otlp.UnmarshalJSON([]byte(`{
+		"resourceMetrics": [{
+			"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "checkout"}}]},
+			"scopeMetrics": [{
+				"scope": {"name": "manual"},
+				"metrics": [
+					{"name": "queue.size", "unit": "1", "gauge": {"dataPoints": [
+						{"attributes": [{"key": "queue", "value": {"stringValue": "orders"}}], "timeUnixNano": "1700000000000000000", "asInt": "12"}
+					]}},
+					{"name": "http.requests", "description": "Requests served", "sum": {"aggregationTemporality": 2, "isMonotonic": true, "dataPoints": [
+						{"startTimeUnixNano": "1699999990000000000", "timeUnixNano": "1700000000000000000", "asDouble": 42},
+						{"timeUnixNano": 1700000010000000000, "flags": 1}
+					]}},
+					{"name": "http.duration", "unit": "ms", "histogram": {"aggregationTemporality": 1, "dataPoints": [
+						{"timeUnixNano": "1700000000000000000", "count": "6", "sum": 250.5, "bucketCounts": ["1", "3", 2], "explicitBounds": [10, 100]}
+					]}}
+				]
+			}]
+		}]
+	}`))
+	require.NoError(t, err)
+	assert.Equal(t, sample, got)
+
+	_, err = otlp.UnmarshalJSON([]byte(`{"resourceMetrics": [{"scopeMetrics": [{"metrics": [{"name": "x", "gauge": {"dataPoints": [{"asInt": "twelve"}]}}]}]}]}`))
+	assert.Error(t, err)
+}
+
+func TestMarshalResponse(t *testing.T) {
+	assert.Equal(t, "{}", string(otlp.MarshalResponse(0, "", true)))
+	assert.JSONEq(t, `{"partialSuccess":{"rejectedDataPoints":"2","errorMessage":"bad"}}`, string(otlp.MarshalResponse(2, "bad", true)))
+	assert.Empty(t, otlp.MarshalResponse(0, "", false))
+	assert.Equal(t, []byte{0x0a, 0x07, 0x08, 0x02, 0x12, 0x03, 'b', 'a', 'd'}, otlp.MarshalResponse(2, "bad", false))
+	assert.JSONEq(t, `{"code":3,"message":"bad"}`, string(otlp.MarshalStatus(3, "bad", true)))
+}
@@ -0,0 +1,116 @@
+// Package otlptest encodes OTLP/HTTP metric exports the way OpenTelemetry SDKs
+// send them. The server only decodes them, so it is meant for tests only.
+package otlptest
+
+import (
+	"math"
+
+	"github.com/fkocharli/metricity/internal/otlp"
+	"github.com/fkocharli/metricity/internal/pbwire"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// noRecordedValue is the data point flag of points without a value.
+const noRecordedValue = 1
+
+// MarshalProto encodes the request as an OTLP/HTTP protobuf body, in a single
+// instrumentation scope per resource.
+func MarshalProto(req otlp.Request) []byte {
+	var b []byte
+	for _, rm := range req.Resources {
+		var resource []byte
+		for _, a := range rm.Attributes {
+			resource = pbwire.AppendMessage(resource, 1, marshalAttribute(a))
+		}
+
+		var scope []byte
+		for _, m := range rm.Metrics {
+			scope = pbwire.AppendMessage(scope, 2, marshalMetric(m))
+		}
+
+		var r []byte
+		r = pbwire.AppendMessage(r, 1, resource)
+		r = pbwire.AppendMessage(r, 2, scope)
+		b = pbwire.AppendMessage(b, 1, r)
+	}
+	return b
+}
+
+func marshalMetric(m otlp.Metric) []byte {
+	var data []byte
+	for _, p := range m.Numbers {
+		var pb []byte
+		for _, a := range p.Attributes {
+			pb = pbwire.AppendMessage(pb, 7, marshalAttribute(a))
+		}
+		pb = appendFixed64(pb, 2, p.StartTime)
+		pb = appendFixed64(pb, 3, p.Time)
+		pb = appendFixed64(pb, 4, math.Float64bits(p.Value))
+		if p.NoValue {
+			pb = appendVarint(pb, 8, noRecordedValue)
+		}
+		data = pbwire.AppendMessage(data, 1, pb)
+	}
+	for _, p := range m.Histograms {
+		var pb []byte
+		for _, a := range p.Attributes {
+			pb = pbwire.AppendMessage(pb, 9, marshalAttribute(a))
+		}
+		pb = appendFixed64(pb, 2, p.StartTime)
+		pb = appendFixed64(pb, 3, p.Time)
+		pb = appendFixed64(pb, 4, p.Count)
+		pb = appendFixed64(pb, 5, math.Float64bits(p.Sum))
+
+		var counts, bounds []byte
+		for _, c := range p.BucketCounts {
+			counts = protowire.AppendFixed64(counts, c)
+		}
+		for _, bound := range p.ExplicitBounds {
+			bounds = protowire.AppendFixed64(bounds, math.Float64bits(bound))
+		}
+		pb = pbwire.AppendMessage(pb, 6, counts)
+		pb = pbwire.AppendMessage(pb, 7, bounds)
+		if p.NoValue {
+			pb = appendVarint(pb, 10, noRecordedValue)
+		}
+		data = pbwire.AppendMessage(data, 1, pb)
+	}
+	if m.Temporality != otlp.TemporalityUnspecified {
+		data = appendVarint(data, 2, uint64(m.Temporality))
+	}
+	if m.Monotonic {
+		data = appendVarint(data, 3, 1)
+	}
+
+	var b []byte
+	b = pbwire.AppendString(b, 1, m.Name)
+	b = pbwire.AppendString(b, 2, m.Description)
+	b = pbwire.AppendString(b, 3, m.Unit)
+	switch m.Kind {
+	case otlp.KindGauge:
+		b = pbwire.AppendMessage(b, 5, data)
+	case otlp.KindSum:
+		b = pbwire.AppendMessage(b, 7, data)
+	case otlp.KindHistogram:
+		b = pbwire.AppendMessage(b, 9, data)
+	}
+	return b
+}
+
+func marshalAttribute(a otlp.Attribute) []byte {
+	var b []byte
+	b = pbwire.AppendString(b, 1, a.Key)
+	b = pbwire.AppendMessage(b, 2, pbwire.AppendString(nil, 1, a.Value))
+	return b
+}
+
+func appendFixed64(b []byte, num protowire.Number, x uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, x)
+}
+
+func appendVarint(b []byte, num protowire.Number, x uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, x)
+}
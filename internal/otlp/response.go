@@ -0,0 +1,52 @@
+package otlp
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/fkocharli/metricity/internal/pbwire"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// MarshalResponse encodes an ExportMetricsServiceResponse, reporting a partial
+// success when some data points were rejected.
+func MarshalResponse(rejected int64, msg string, asJSON bool) []byte {
+	if asJSON {
+		if rejected == 0 {
+			return []byte("{}")
+		}
+		b, _ := json.Marshal(map[string]interface{}{
+			"partialSuccess": map[string]string{
+				"rejectedDataPoints": strconv.FormatInt(rejected, 10),
+				"errorMessage":       msg,
+			},
+		})
+		return b
+	}
+
+	if rejected == 0 {
+		return nil
+	}
+	var partial []byte
+	partial = appendVarint(partial, 1, uint64(rejected))
+	partial = pbwire.AppendString(partial, 2, msg)
+	return pbwire.AppendMessage(nil, 1, partial)
+}
+
+// MarshalStatus encodes a google.rpc.Status, the body of OTLP/HTTP error responses.
+func MarshalStatus(code int32, msg string, asJSON bool) []byte {
+	if asJSON {
+		b, _ := json.Marshal(map[string]interface{}{"code": code, "message": msg})
+		return b
+	}
+
+	var b []byte
+	b = appendVarint(b, 1, uint64(code))
+	return pbwire.AppendString(b, 2, msg)
+}
+
+func appendVarint(b []byte, num protowire.Number, x uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, x)
+}
@@ -0,0 +1,80 @@
+// Package pbwire helps decoding protobuf messages by hand for the few
+// third-party formats the server accepts, without generated code.
+package pbwire
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Walk calls fn for every field of the message b with the field payload:
+// v for length-delimited fields, x for varint and fixed-size ones.
+// Groups are skipped.
+func Walk(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, x uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("invalid protobuf tag: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		var (
+			v    []byte
+			x    uint64
+			skip bool
+		)
+		switch typ {
+		case protowire.VarintType:
+			x, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			x, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var x32 uint32
+			x32, n = protowire.ConsumeFixed32(b)
+			x = uint64(x32)
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		default:
+			n, skip = protowire.ConsumeFieldValue(num, typ, b), true
+		}
+		if n < 0 {
+			return fmt.Errorf("invalid protobuf field %d: %w", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		if skip {
+			continue
+		}
+		if err := fn(num, typ, v, x); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Messages calls fn for every length-delimited field num of the message b.
+func Messages(b []byte, num protowire.Number, fn func(v []byte) error) error {
+	return Walk(b, func(n protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if n != num || typ != protowire.BytesType {
+			return nil
+		}
+		return fn(v)
+	})
+}
+
+// AppendString appends a string field, omitting it when empty as proto3 does.
+func AppendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// AppendMessage appends the encoded message m as field num.
+func AppendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
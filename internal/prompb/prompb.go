@@ -0,0 +1,160 @@
+// Package prompb decodes Prometheus remote_write requests: snappy-compressed
+// protobuf WriteRequest messages. Only the fields the server uses are read,
+// everything else (exemplars, native histograms) is skipped.
+package prompb
+
+import (
+	"errors"
+	"math"
+
+	"github.com/fkocharli/metricity/internal/pbwire"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var ErrTooLarge = errors.New("decoded remote write request is too large")
+
+// MetricType is the type of a metric family as sent in the request metadata.
+type MetricType int32
+
+const (
+	Unknown MetricType = iota
+	Counter
+	Gauge
+	Histogram
+	GaugeHistogram
+	Summary
+	Info
+	StateSet
+)
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+type MetricMetadata struct {
+	Type       MetricType
+	FamilyName string
+	Help       string
+	Unit       string
+}
+
+type WriteRequest struct {
+	Timeseries []TimeSeries
+	Metadata   []MetricMetadata
+}
+
+// Decode decompresses and parses a remote_write body. maxSize limits the
+// decompressed size, 0 means no limit.
+func Decode(body []byte, maxSize int) (WriteRequest, error) {
+	n, err := snappy.DecodedLen(body)
+	if err != nil {
+		return WriteRequest{}, err
+	}
+	if maxSize > 0 && n > maxSize {
+		return WriteRequest{}, ErrTooLarge
+	}
+
+	b, err := snappy.Decode(nil, body)
+	if err != nil {
+		return WriteRequest{}, err
+	}
+
+	return Unmarshal(b)
+}
+
+// Unmarshal parses an uncompressed WriteRequest.
+func Unmarshal(b []byte) (WriteRequest, error) {
+	var req WriteRequest
+	err := pbwire.Walk(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			ts, err := unmarshalTimeSeries(v)
+			if err != nil {
+				return err
+			}
+			req.Timeseries = append(req.Timeseries, ts)
+		case num == 3 && typ == protowire.BytesType:
+			md, err := unmarshalMetadata(v)
+			if err != nil {
+				return err
+			}
+			req.Metadata = append(req.Metadata, md)
+		}
+		return nil
+	})
+
+	return req, err
+}
+
+func unmarshalTimeSeries(b []byte) (TimeSeries, error) {
+	var ts TimeSeries
+	err := pbwire.Walk(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			var l Label
+			err := pbwire.Walk(v, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					l.Name = string(v)
+				case num == 2 && typ == protowire.BytesType:
+					l.Value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Labels = append(ts.Labels, l)
+		case num == 2 && typ == protowire.BytesType:
+			var s Sample
+			err := pbwire.Walk(v, func(num protowire.Number, typ protowire.Type, _ []byte, x uint64) error {
+				switch {
+				case num == 1 && typ == protowire.Fixed64Type:
+					s.Value = math.Float64frombits(x)
+				case num == 2 && typ == protowire.VarintType:
+					s.Timestamp = int64(x)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, s)
+		}
+		return nil
+	})
+
+	return ts, err
+}
+
+func unmarshalMetadata(b []byte) (MetricMetadata, error) {
+	var md MetricMetadata
+	err := pbwire.Walk(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			md.Type = MetricType(x)
+		case num == 2 && typ == protowire.BytesType:
+			md.FamilyName = string(v)
+		case num == 4 && typ == protowire.BytesType:
+			md.Help = string(v)
+		case num == 5 && typ == protowire.BytesType:
+			md.Unit = string(v)
+		}
+		return nil
+	})
+
+	return md, err
+}
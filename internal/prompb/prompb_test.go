@@ -0,0 +1,62 @@
+package prompb_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/fkocharli/metricity/internal/pbwire"
+	"github.com/fkocharli/metricity/internal/prompb"
+	"github.com/fkocharli/metricity/internal/prompb/prompbtest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestRoundTrip(t *testing.T) {
+	req := prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels:  []prompb.Label{{Name: "__name__", Value: "http_requests_total"}, {Name: "code", Value: "200"}},
+				Samples: []prompb.Sample{{Value: 10, Timestamp: 1700000000000}, {Value: 12.5, Timestamp: 1700000015000}},
+			},
+			{
+				Labels:  []prompb.Label{{Name: "__name__", Value: "temperature"}},
+				Samples: []prompb.Sample{{Value: -3.5, Timestamp: -1}},
+			},
+		},
+		Metadata: []prompb.MetricMetadata{{Type: prompb.Counter, FamilyName: "http_requests_total", Help: "Requests.", Unit: "requests"}},
+	}
+
+	got, err := prompb.Decode(prompbtest.Encode(req), 0)
+	require.NoError(t, err)
+	assert.Equal(t, req, got)
+
+	_, err = prompb.Decode(prompbtest.Encode(req), 10)
+	assert.Equal(t, prompb.ErrTooLarge, err)
+
+	_, err = prompb.Decode([]byte("not snappy"), 0)
+	assert.Error(t, err)
+}
+
+func TestUnknownFieldsAreSkipped(t *testing.T) {
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(1.5))
+
+	var ts []byte
+	ts = pbwire.AppendMessage(ts, 2, sample)
+	// An exemplar and a native histogram, which aren't supported.
+	ts = pbwire.AppendMessage(ts, 3, []byte{0x12, 0x00})
+	ts = pbwire.AppendMessage(ts, 4, []byte{0x08, 0x01})
+	ts = protowire.AppendTag(ts, 9, protowire.Fixed32Type)
+	ts = protowire.AppendFixed32(ts, 7)
+
+	got, err := prompb.Unmarshal(pbwire.AppendMessage(nil, 1, ts))
+	require.NoError(t, err)
+	require.Len(t, got.Timeseries, 1)
+	assert.Equal(t, []prompb.Sample{{Value: 1.5}}, got.Timeseries[0].Samples)
+
+	_, err = prompb.Unmarshal([]byte{0x0a, 0x05, 0x01})
+	assert.Error(t, err)
+}
@@ -0,0 +1,52 @@
+// Package prompbtest encodes remote_write requests the way Prometheus sends them.
+// The server only decodes them, so it is meant for tests only.
+package prompbtest
+
+import (
+	"math"
+
+	"github.com/fkocharli/metricity/internal/pbwire"
+	"github.com/fkocharli/metricity/internal/prompb"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Encode marshals and compresses the request the way Prometheus sends it.
+func Encode(req prompb.WriteRequest) []byte {
+	return snappy.Encode(nil, Marshal(req))
+}
+
+// Marshal returns the uncompressed protobuf encoding of the request.
+func Marshal(req prompb.WriteRequest) []byte {
+	var b []byte
+	for _, ts := range req.Timeseries {
+		var m []byte
+		for _, l := range ts.Labels {
+			var lb []byte
+			lb = pbwire.AppendString(lb, 1, l.Name)
+			lb = pbwire.AppendString(lb, 2, l.Value)
+			m = pbwire.AppendMessage(m, 1, lb)
+		}
+		for _, s := range ts.Samples {
+			var sb []byte
+			sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+			sb = protowire.AppendFixed64(sb, math.Float64bits(s.Value))
+			sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+			sb = protowire.AppendVarint(sb, uint64(s.Timestamp))
+			m = pbwire.AppendMessage(m, 2, sb)
+		}
+		b = pbwire.AppendMessage(b, 1, m)
+	}
+	for _, md := range req.Metadata {
+		var m []byte
+		m = protowire.AppendTag(m, 1, protowire.VarintType)
+		m = protowire.AppendVarint(m, uint64(md.Type))
+		m = pbwire.AppendString(m, 2, md.FamilyName)
+		m = pbwire.AppendString(m, 4, md.Help)
+		m = pbwire.AppendString(m, 5, md.Unit)
+		b = pbwire.AppendMessage(b, 3, m)
+	}
+
+	return b
+}
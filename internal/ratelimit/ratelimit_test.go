@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLimiter(rate float64, burst int) (*Limiter, *time.Time) {
+	l := New(rate, burst)
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	l.lastSweep = now
+	return l, &now
+}
+
+func TestLimiterBurst(t *testing.T) {
+	l, _ := newTestLimiter(1, 3)
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a")
+		assert.True(t, ok, "request %d", i)
+	}
+
+	ok, wait := l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	// Every key has its own bucket.
+	ok, _ = l.Allow("b")
+	assert.True(t, ok)
+}
+
+func TestLimiterRefill(t *testing.T) {
+	l, now := newTestLimiter(2, 2)
+
+	for i := 0; i < 2; i++ {
+		ok, _ := l.Allow("a")
+		assert.True(t, ok)
+	}
+	ok, wait := l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	*now = now.Add(250 * time.Millisecond)
+	ok, wait = l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 250*time.Millisecond, wait)
+
+	*now = now.Add(250 * time.Millisecond)
+	ok, _ = l.Allow("a")
+	assert.True(t, ok)
+
+	// Idle time refills the bucket up to Burst only.
+	*now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		ok, _ := l.Allow("a")
+		assert.True(t, ok)
+	}
+	ok, _ = l.Allow("a")
+	assert.False(t, ok)
+}
+
+func TestLimiterDefaultBurst(t *testing.T) {
+	l, _ := newTestLimiter(0.5, 0)
+	assert.Equal(t, 1.0, l.Burst)
+
+	ok, _ := l.Allow("a")
+	assert.True(t, ok)
+	ok, wait := l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 2*time.Second, wait)
+}
+
+func TestLimiterSweep(t *testing.T) {
+	l, now := newTestLimiter(1, 1)
+
+	l.Allow("a")
+	assert.Len(t, l.buckets, 1)
+
+	*now = now.Add(sweepInterval)
+	l.Allow("b")
+	assert.Len(t, l.buckets, 1)
+	assert.Contains(t, l.buckets, "b")
+}
@@ -0,0 +1,245 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fkocharli/metricity/internal/atomicfile"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrUnknownMetric = errors.New("metric is not registered")
+	ErrTypeMismatch  = errors.New("metric type contradicts the registry")
+	ErrInvalidEntry  = errors.New("invalid registry entry")
+)
+
+// Metric describes a metric the server expects to receive.
+type Metric struct {
+	Name        string `json:"name" yaml:"name"`
+	Type        string `json:"type" yaml:"type"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	Unit        string `json:"unit,omitempty" yaml:"unit,omitempty"`
+	Owner       string `json:"owner,omitempty" yaml:"owner,omitempty"`
+}
+
+// Registry validates incoming metrics against the known ones and provides their
+// metadata. Metrics missing from the registry are accepted unless Strict is set.
+// A nil *Registry accepts everything, so backends stay schema-free by default.
+// When Path is set, changes made with Set and Delete are written back to it.
+type Registry struct {
+	Path    string
+	Strict  bool
+	Mutex   *sync.RWMutex
+	metrics map[string]Metric
+}
+
+func New(metrics []Metric, strict bool) (*Registry, error) {
+	r := &Registry{
+		Strict:  strict,
+		Mutex:   &sync.RWMutex{},
+		metrics: make(map[string]Metric, len(metrics)),
+	}
+
+	for _, m := range metrics {
+		if err := m.validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := r.metrics[m.Name]; ok {
+			return nil, fmt.Errorf("%w: %s is duplicated", ErrInvalidEntry, m.Name)
+		}
+		r.metrics[m.Name] = m
+	}
+
+	return r, nil
+}
+
+// Load reads a list of metrics from a YAML (.yaml, .yml) or JSON file. A missing
+// file gives an empty registry which is created on the first change.
+func Load(path string, strict bool) (*Registry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	var metrics []Metric
+	if len(bytes.TrimSpace(b)) > 0 {
+		if isYAML(path) {
+			err = yaml.Unmarshal(b, &metrics)
+		} else {
+			err = json.Unmarshal(b, &metrics)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse registry %s: %v", path, err)
+		}
+	}
+
+	r, err := New(metrics, strict)
+	if err != nil {
+		return nil, err
+	}
+	r.Path = path
+
+	return r, nil
+}
+
+// Lookup returns the entry of the metric. A labelled series, e.g.
+// http_requests_total{code="200"}, has the entry of its family, the name before
+// the labels, unless the series is registered on its own.
+func (r *Registry) Lookup(name string) (Metric, bool) {
+	if r == nil {
+		return Metric{}, false
+	}
+
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+
+	m, ok := r.metrics[name]
+	if i := strings.IndexByte(name, '{'); !ok && i > 0 {
+		m, ok = r.metrics[name[:i]]
+	}
+	return m, ok
+}
+
+// All returns the registered metrics ordered by name.
+func (r *Registry) All() []Metric {
+	if r == nil {
+		return nil
+	}
+
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+
+	res := make([]Metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		res = append(res, m)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	return res
+}
+
+// Set adds or replaces the metric and saves the registry.
+func (r *Registry) Set(m Metric) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	old, existed := r.metrics[m.Name]
+	r.metrics[m.Name] = m
+
+	if err := r.save(); err != nil {
+		if existed {
+			r.metrics[m.Name] = old
+		} else {
+			delete(r.metrics, m.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the metric and saves the registry.
+func (r *Registry) Delete(name string) error {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	old, ok := r.metrics[name]
+	if !ok {
+		return ErrUnknownMetric
+	}
+	delete(r.metrics, name)
+
+	if err := r.save(); err != nil {
+		r.metrics[name] = old
+		return err
+	}
+	return nil
+}
+
+// Validate rejects a metric whose type differs from the registered one and,
+// in strict mode, a metric that isn't registered at all.
+func (r *Registry) Validate(name, mtype string) error {
+	if r == nil {
+		return nil
+	}
+
+	m, ok := r.Lookup(name)
+	if !ok {
+		if r.Strict {
+			return ErrUnknownMetric
+		}
+		return nil
+	}
+	if m.Type != mtype {
+		return ErrTypeMismatch
+	}
+	return nil
+}
+
+// Help returns the description of the metric with its unit, or an empty string.
+func (r *Registry) Help(name string) string {
+	m, ok := r.Lookup(name)
+	if !ok || m.Description == "" {
+		return ""
+	}
+	if m.Unit != "" {
+		return fmt.Sprintf("%s (%s)", m.Description, m.Unit)
+	}
+	return m.Description
+}
+
+func (m Metric) validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("%w: no name", ErrInvalidEntry)
+	}
+	if m.Type != "gauge" && m.Type != "counter" {
+		return fmt.Errorf("%w: %s has unknown type %q", ErrInvalidEntry, m.Name, m.Type)
+	}
+	return nil
+}
+
+// save writes the registry to a temporary file and renames it over Path,
+// so a crash never leaves a half-written registry behind.
+func (r *Registry) save() error {
+	if r.Path == "" {
+		return nil
+	}
+
+	metrics := make([]Metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+
+	var (
+		b   []byte
+		err error
+	)
+	if isYAML(r.Path) {
+		b, err = yaml.Marshal(metrics)
+	} else {
+		b, err = json.MarshalIndent(metrics, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteBytes(r.Path, b)
+}
+
+func isYAML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
@@ -0,0 +1,80 @@
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"name": "Alloc", "type": "gauge", "description": "Allocated heap objects", "unit": "bytes"},
+		{"name": "PollCount", "type": "counter", "description": "Number of polls"},
+		{"name": "RandomValue", "type": "gauge"}
+	]`), 0644))
+
+	r, err := Load(path, false)
+	require.NoError(t, err)
+
+	assert.NoError(t, r.Validate("Alloc", "gauge"))
+	assert.Equal(t, ErrTypeMismatch, r.Validate("Alloc", "counter"))
+	assert.NoError(t, r.Validate("Unknown", "gauge"))
+
+	// Labelled series go by their family.
+	assert.NoError(t, r.Validate(`PollCount{host="a"}`, "counter"))
+	assert.Equal(t, ErrTypeMismatch, r.Validate(`PollCount{host="a"}`, "gauge"))
+	assert.Equal(t, "Number of polls", r.Help(`PollCount{host="a"}`))
+
+	assert.Equal(t, "Allocated heap objects (bytes)", r.Help("Alloc"))
+	assert.Equal(t, "Number of polls", r.Help("PollCount"))
+	assert.Empty(t, r.Help("RandomValue"))
+	assert.Empty(t, r.Help("Unknown"))
+
+	r.Strict = true
+	assert.Equal(t, ErrUnknownMetric, r.Validate("Unknown", "gauge"))
+	assert.Equal(t, ErrUnknownMetric, r.Validate(`Unknown{PollCount="1"}`, "gauge"))
+
+	var empty *Registry
+	assert.NoError(t, empty.Validate("Unknown", "histogram"))
+	assert.Empty(t, empty.Help("Alloc"))
+
+	_, err = New([]Metric{{Name: "Alloc", Type: "histogram"}}, false)
+	assert.Error(t, err)
+	_, err = New([]Metric{{Name: "Alloc", Type: "gauge"}, {Name: "Alloc", Type: "gauge"}}, false)
+	assert.Error(t, err)
+}
+
+func TestRegistryPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+- name: Alloc
+  type: gauge
+  description: Allocated heap objects
+  unit: bytes
+  owner: runtime
+`), 0644))
+
+	r, err := Load(path, false)
+	require.NoError(t, err)
+
+	m, ok := r.Lookup("Alloc")
+	require.True(t, ok)
+	assert.Equal(t, "runtime", m.Owner)
+
+	require.NoError(t, r.Set(Metric{Name: "PollCount", Type: "counter", Unit: "polls", Owner: "agent"}))
+	assert.ErrorIs(t, r.Set(Metric{Name: "Bad", Type: "summary"}), ErrInvalidEntry)
+	require.NoError(t, r.Delete("Alloc"))
+	assert.Equal(t, ErrUnknownMetric, r.Delete("Alloc"))
+
+	r, err = Load(path, false)
+	require.NoError(t, err)
+	assert.Equal(t, []Metric{{Name: "PollCount", Type: "counter", Unit: "polls", Owner: "agent"}}, r.All())
+
+	r, err = Load(filepath.Join(t.TempDir(), "missing.json"), false)
+	require.NoError(t, err)
+	assert.Empty(t, r.All())
+}
@@ -0,0 +1,126 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+type BatchMode string
+
+const (
+	// BatchAtomic writes the batch only if every metric in it is valid.
+	BatchAtomic BatchMode = "atomic"
+	// BatchBestEffort writes the valid metrics and rejects the rest.
+	BatchBestEffort BatchMode = "best-effort"
+)
+
+var (
+	ErrBatchRejected    = errors.New("batch contains invalid metrics")
+	ErrUnknownBatchMode = errors.New("unknown batch mode")
+)
+
+type BatchItem struct {
+	Index int    `json:"index"`
+	ID    string `json:"id"`
+	MType string `json:"type"`
+	Error string `json:"error,omitempty"`
+}
+
+type BatchResult struct {
+	Accepted []BatchItem `json:"accepted"`
+	Rejected []BatchItem `json:"rejected"`
+}
+
+func ParseBatchMode(s string) (BatchMode, error) {
+	switch BatchMode(s) {
+	case "", BatchAtomic:
+		return BatchAtomic, nil
+	case BatchBestEffort:
+		return BatchBestEffort, nil
+	default:
+		return "", ErrUnknownBatchMode
+	}
+}
+
+// UpdateBatchMetrics validates every metric before writing any of them. In atomic mode
+// a single invalid metric rejects the whole batch with ErrBatchRejected, in best-effort
+// mode only the valid ones are written. The result enumerates accepted and rejected items.
+func (s *Storager) UpdateBatchMetrics(ctx context.Context, metrics []Metrics, mode BatchMode) (BatchResult, error) {
+	return s.updateBatch(ctx, metrics, mode, s.ValidateMetric)
+}
+
+// UpdateTrustedBatchMetrics is UpdateBatchMetrics for metrics without hashes whose
+// sender was authorized otherwise, e.g. by the key in a request header.
+func (s *Storager) UpdateTrustedBatchMetrics(ctx context.Context, metrics []Metrics, mode BatchMode) (BatchResult, error) {
+	return s.updateBatch(ctx, metrics, mode, s.ValidateTrustedMetric)
+}
+
+func (s *Storager) updateBatch(ctx context.Context, metrics []Metrics, mode BatchMode, validate func(Metrics) error) (BatchResult, error) {
+	res := BatchResult{
+		Accepted: []BatchItem{},
+		Rejected: []BatchItem{},
+	}
+
+	errs := make([]error, len(metrics))
+	valid := make([]Metrics, 0, len(metrics))
+	invalid := 0
+	for i, m := range metrics {
+		if errs[i] = validate(m); errs[i] != nil {
+			invalid++
+			continue
+		}
+		valid = append(valid, m)
+	}
+
+	if invalid > 0 {
+		log.Printf("Batch update: %d of %d metrics rejected", invalid, len(metrics))
+	}
+
+	atomicReject := invalid > 0 && mode != BatchBestEffort
+	for i, m := range metrics {
+		item := BatchItem{Index: i, ID: m.ID, MType: m.MType}
+		switch {
+		case errs[i] != nil:
+			item.Error = errs[i].Error()
+			res.Rejected = append(res.Rejected, item)
+		case atomicReject:
+			item.Error = "not written: " + ErrBatchRejected.Error()
+			res.Rejected = append(res.Rejected, item)
+		default:
+			res.Accepted = append(res.Accepted, item)
+		}
+	}
+
+	if atomicReject {
+		return res, ErrBatchRejected
+	}
+
+	if len(valid) == 0 {
+		return res, nil
+	}
+
+	err := s.journal(func() ([]Metrics, error) {
+		if err := s.Repo.UpdateBatchMetrics(ctx, valid); err != nil {
+			log.Printf("Error: %v", err)
+			return nil, storageError(err, ErrStorageFailure)
+		}
+		if !s.syncToFile() {
+			return nil, nil
+		}
+		return s.currentValues(ctx, valid), nil
+	})
+	if err != nil {
+		return BatchResult{}, err
+	}
+
+	s.History.Touch(valid...)
+
+	// Subscribers get counter totals, which costs a read per metric, so skip it if nobody listens.
+	if s.Broker.HasSubscribers() {
+		s.Broker.Publish(s.currentValues(ctx, valid)...)
+	}
+	s.forward(valid...)
+
+	return res, nil
+}
@@ -0,0 +1,128 @@
+package repositories
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Filter selects metrics by ID prefix and type; empty fields match everything.
+type Filter struct {
+	Prefix string
+	Type   string
+}
+
+func (f Filter) Match(m Metrics) bool {
+	return strings.HasPrefix(m.ID, f.Prefix) && (f.Type == "" || f.Type == m.MType)
+}
+
+// Subscription receives the metrics accepted by the Storager on C. Counters carry
+// their total in Delta. C is closed when the subscription or the broker is closed.
+type Subscription struct {
+	C       <-chan Metrics
+	ch      chan Metrics
+	filter  Filter
+	broker  *Broker
+	dropped uint64
+}
+
+// Dropped is the number of metrics discarded because C was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscription) Close() {
+	s.broker.unsubscribe(s)
+}
+
+// Broker fans accepted metric updates out to subscribers. Publishing never blocks:
+// a subscriber that doesn't keep up loses updates instead of slowing down writes.
+// A nil *Broker publishes nothing.
+type Broker struct {
+	Mutex  *sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		Mutex: &sync.RWMutex{},
+		subs:  make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe registers a subscriber for the metrics matching f, buffering up to buffer of them.
+func (b *Broker) Subscribe(f Filter, buffer int) *Subscription {
+	ch := make(chan Metrics, buffer)
+	s := &Subscription{C: ch, ch: ch, filter: f, broker: b}
+
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
+	if b.closed {
+		close(ch)
+		return s
+	}
+	b.subs[s] = struct{}{}
+
+	return s
+}
+
+func (b *Broker) unsubscribe(s *Subscription) {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+}
+
+func (b *Broker) HasSubscribers() bool {
+	if b == nil {
+		return false
+	}
+
+	b.Mutex.RLock()
+	defer b.Mutex.RUnlock()
+
+	return len(b.subs) > 0
+}
+
+func (b *Broker) Publish(metrics ...Metrics) {
+	if b == nil {
+		return
+	}
+
+	b.Mutex.RLock()
+	defer b.Mutex.RUnlock()
+
+	for s := range b.subs {
+		for _, m := range metrics {
+			if !s.filter.Match(m) {
+				continue
+			}
+			select {
+			case s.ch <- m:
+			default:
+				atomic.AddUint64(&s.dropped, 1)
+			}
+		}
+	}
+}
+
+// Close ends all subscriptions, e.g. to let streaming clients go on shutdown.
+func (b *Broker) Close() {
+	if b == nil {
+		return
+	}
+
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
+	for s := range b.subs {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+	b.closed = true
+}
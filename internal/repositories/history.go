@@ -0,0 +1,130 @@
+package repositories
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Point is a metric value sampled at Time. Counters are sampled as their total.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// History keeps the last Size samples of every metric and the time each metric was
+// last written, for the dashboard. A nil *History records nothing.
+type History struct {
+	Size    int
+	Mutex   *sync.RWMutex
+	series  map[string][]Point
+	updated map[string]time.Time
+	now     func() time.Time
+}
+
+func NewHistory(size int) *History {
+	return &History{
+		Size:    size,
+		Mutex:   &sync.RWMutex{},
+		series:  make(map[string][]Point),
+		updated: make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+func historyKey(mtype, id string) string {
+	return mtype + ":" + id
+}
+
+// Touch marks the metrics as written now.
+func (h *History) Touch(metrics ...Metrics) {
+	if h == nil {
+		return
+	}
+
+	now := h.now()
+
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	for _, m := range metrics {
+		h.updated[historyKey(m.MType, m.ID)] = now
+	}
+}
+
+// Sample appends the current values of the metrics, dropping samples beyond Size.
+func (h *History) Sample(metrics []Metrics) {
+	if h == nil || h.Size <= 0 {
+		return
+	}
+
+	now := h.now()
+
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	for _, m := range metrics {
+		var v float64
+		switch {
+		case m.MType == "gauge" && m.Value != nil:
+			v = *m.Value
+		case m.MType == "counter" && m.Delta != nil:
+			v = float64(*m.Delta)
+		default:
+			continue
+		}
+
+		key := historyKey(m.MType, m.ID)
+		points := append(h.series[key], Point{Time: now, Value: v})
+		if len(points) > h.Size {
+			points = append(points[:0:0], points[len(points)-h.Size:]...)
+		}
+		h.series[key] = points
+	}
+}
+
+// Series returns a copy of the samples of the metric, oldest first.
+func (h *History) Series(mtype, id string) []Point {
+	if h == nil {
+		return nil
+	}
+
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+
+	return append([]Point(nil), h.series[historyKey(mtype, id)]...)
+}
+
+// Updated returns when the metric was last written since the server started.
+func (h *History) Updated(mtype, id string) (time.Time, bool) {
+	if h == nil {
+		return time.Time{}, false
+	}
+
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+
+	t, ok := h.updated[historyKey(mtype, id)]
+	return t, ok
+}
+
+// Run samples all stored metrics of s on every tick until ctx is cancelled.
+func (h *History) Run(ctx context.Context, interval time.Duration, s *Storager) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			metrics, err := s.ListMetrics(ctx)
+			if err != nil {
+				log.Printf("Unable to sample metric history. Error: %v", err)
+				continue
+			}
+			h.Sample(metrics)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package repositories
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -9,7 +10,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"sort"
 	"strconv"
+
+	"github.com/fkocharli/metricity/internal/registry"
 )
 
 var (
@@ -22,6 +27,10 @@ var (
 	ErrUnableUpdateGauge     = errors.New("unable update gauge")
 	ErrIncorrectCounterValue = errors.New("incorrect counter value")
 	ErrIncorrectGaugeValue   = errors.New("incorrect gauge value")
+	ErrStorageTimeout        = errors.New("storage operation timed out")
+	ErrStorageCanceled       = errors.New("storage operation canceled")
+	ErrStorageFailure        = errors.New("storage backend failure")
+	ErrEmptyMetricID         = errors.New("metric id is empty")
 )
 
 type Metrics struct {
@@ -65,30 +74,49 @@ func (m Metrics) String() string {
 	return fmt.Sprintf("ID: %v, Type: %v, Delta: %v, Value: %v", m.ID, m.MType, delta, value)
 }
 
+// Storage is implemented by metric backends. Reads of a single metric return an error
+// wrapping ErrMetricNotFound when the metric doesn't exist; any other error is a backend fault.
 type Storage interface {
-	UpdateBatchMetrics([]Metrics) error
-	UpdateGaugeMetrics(name, value string) error
-	UpdateCounterMetrics(name, value string) (int64, error)
-	GetGaugeMetrics(name string) (string, error)
-	GetCounterMetrics(name string) (string, error)
-	GetAllGaugeMetrics() []Metrics
-	GetAllCounterMetrics() []Metrics
-	Ping() error
+	UpdateBatchMetrics(ctx context.Context, metrics []Metrics) error
+	UpdateGaugeMetrics(ctx context.Context, name, value string) error
+	UpdateCounterMetrics(ctx context.Context, name, value string) (int64, error)
+	GetGaugeMetrics(ctx context.Context, name string) (string, error)
+	GetCounterMetrics(ctx context.Context, name string) (string, error)
+	GetAllGaugeMetrics(ctx context.Context) ([]Metrics, error)
+	GetAllCounterMetrics(ctx context.Context) ([]Metrics, error)
+	Ping(ctx context.Context) error
+}
+
+// Seeder is implemented by backends that can store metrics only where they are
+// missing, in one atomic operation, so seeding never overwrites newer values.
+type Seeder interface {
+	SeedMetrics(ctx context.Context, metrics []Metrics) error
 }
 
 type FileRepository interface {
 	Sync() bool
 	LoadFromDisk() ([]Metrics, error)
-	SaveAllToDisk(m []Metrics) error
-	SaveToDisk(m Metrics) error
-	FileWriterClose() error
-	FileReaderClose() error
+	LoadLog() ([]Metrics, error)
+	SaveAllToDisk(snapshot func() ([]Metrics, error)) error
+	AppendToLog(update func() ([]Metrics, error)) error
+	Close() error
+}
+
+// Forwarder receives the updates accepted by the Storager as they were sent,
+// counters as increments, e.g. to replicate them to another server. Forward
+// must not block.
+type Forwarder interface {
+	Forward(metrics ...Metrics)
 }
 
 type Storager struct {
-	Repo     Storage
-	FileRepo FileRepository
-	Key      string
+	Repo       Storage
+	FileRepo   FileRepository
+	Key        string
+	Registry   *registry.Registry
+	History    *History
+	Broker     *Broker
+	Forwarders []Forwarder
 }
 
 func NewStorager(storage Storage, fileRepo FileRepository, key string) Storager {
@@ -99,13 +127,13 @@ func NewStorager(storage Storage, fileRepo FileRepository, key string) Storager
 	}
 }
 
-func (s *Storager) GetMetric(m Metrics) (Metrics, error) {
+func (s *Storager) GetMetric(ctx context.Context, m Metrics) (Metrics, error) {
 	switch m.MType {
 	case "counter":
-		v, err := s.Repo.GetCounterMetrics(m.ID)
+		v, err := s.Repo.GetCounterMetrics(ctx, m.ID)
 		if err != nil {
 			log.Printf("Error: %v \n", err)
-			return m, ErrMetricNotFound
+			return m, storageError(err, ErrStorageFailure)
 		}
 		x, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
@@ -117,10 +145,10 @@ func (s *Storager) GetMetric(m Metrics) (Metrics, error) {
 			m.Hash = hash(fmt.Sprintf("%s:counter:%d", m.ID, *m.Delta), s.Key)
 		}
 	case "gauge":
-		v, err := s.Repo.GetGaugeMetrics(m.ID)
+		v, err := s.Repo.GetGaugeMetrics(ctx, m.ID)
 		if err != nil {
 			log.Printf("Error: %v", err)
-			return m, ErrMetricNotFound
+			return m, storageError(err, ErrStorageFailure)
 		}
 		x, err := strconv.ParseFloat(v, 64)
 		if err != nil {
@@ -138,80 +166,198 @@ func (s *Storager) GetMetric(m Metrics) (Metrics, error) {
 	return m, nil
 }
 
-func (s *Storager) UpdateBatchMetrics(metrics []Metrics) error {
-	err := s.Repo.UpdateBatchMetrics(metrics)
-	if err != nil {
-		return err
+func (s *Storager) UpdateMetrics(ctx context.Context, metrics Metrics) (Metrics, error) {
+	if err := s.ValidateMetric(metrics); err != nil {
+		log.Printf("Error: %v. Metric: %v", err, metrics)
+		return Metrics{}, err
 	}
-	return nil
-}
+	accepted := metrics
 
-func (s *Storager) UpdateMetrics(metrics Metrics) (Metrics, error) {
 	switch metrics.MType {
 	case "counter":
-		if metrics.Delta != nil {
-			if s.Key != "" {
-				hash := hash(fmt.Sprintf("%s:counter:%d", metrics.ID, *metrics.Delta), s.Key)
-				if hash != metrics.Hash {
-					log.Println(ErrIncorrectHash)
-					return Metrics{}, ErrIncorrectHash
-				}
-			}
-			v, err := s.Repo.UpdateCounterMetrics(metrics.ID, fmt.Sprintf("%v", *metrics.Delta))
+		err := s.journal(func() ([]Metrics, error) {
+			v, err := s.Repo.UpdateCounterMetrics(ctx, metrics.ID, fmt.Sprintf("%v", *metrics.Delta))
 			if err != nil {
 				log.Printf("Error: %v", err)
-				return Metrics{}, ErrUnableUpdateCounter
+				return nil, storageError(err, ErrUnableUpdateCounter)
 			}
 			metrics.Delta = &v
-		} else {
-			log.Printf("Error: Delta for %v Not Provided", metrics.ID)
-			return Metrics{}, ErrIncorrectCounterValue
+			return []Metrics{{ID: metrics.ID, MType: metrics.MType, Delta: &v}}, nil
+		})
+		if err != nil {
+			return Metrics{}, err
 		}
 
 	case "gauge":
-		if metrics.Value != nil {
-			if s.Key != "" {
-				hash := hash(fmt.Sprintf("%s:gauge:%f", metrics.ID, *metrics.Value), s.Key)
-				if hash != metrics.Hash {
-					log.Println("Hash is not correct")
-					return Metrics{}, ErrIncorrectHash
-				}
-			}
-			err := s.Repo.UpdateGaugeMetrics(metrics.ID, fmt.Sprintf("%v", *metrics.Value))
+		err := s.journal(func() ([]Metrics, error) {
+			err := s.Repo.UpdateGaugeMetrics(ctx, metrics.ID, fmt.Sprintf("%v", *metrics.Value))
 			if err != nil {
 				log.Printf("Error: %v", err)
-				return Metrics{}, ErrUnableUpdateGauge
+				return nil, storageError(err, ErrUnableUpdateGauge)
 			}
-		} else {
-			log.Printf("Error: Value for %v Not Provided", metrics.ID)
-			return Metrics{}, ErrIncorrectGaugeValue
+			return []Metrics{{ID: metrics.ID, MType: metrics.MType, Value: metrics.Value}}, nil
+		})
+		if err != nil {
+			return Metrics{}, err
+		}
+	}
+
+	s.History.Touch(metrics)
+
+	published := metrics
+	published.Hash = ""
+	s.Broker.Publish(published)
+	s.forward(accepted)
+
+	return metrics, nil
+}
+
+// ValidateMetric checks that the metric can be written, see ValidateTrustedMetric,
+// and, when the key is set, that its hash is correct.
+func (s *Storager) ValidateMetric(m Metrics) error {
+	if err := s.ValidateTrustedMetric(m); err != nil {
+		return err
+	}
+
+	if s.Key != "" && Sign(m, s.Key) != m.Hash {
+		return ErrIncorrectHash
+	}
+
+	return nil
+}
+
+// ValidateTrustedMetric checks that the metric can be written: known type, non-empty ID,
+// a finite value of the right kind and agreement with the registry if one is set.
+// The hash isn't checked, the sender must have been authorized otherwise.
+func (s *Storager) ValidateTrustedMetric(m Metrics) error {
+	switch m.MType {
+	case "counter":
+		if m.Delta == nil {
+			return ErrIncorrectCounterValue
+		}
+	case "gauge":
+		if m.Value == nil || math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0) {
+			return ErrIncorrectGaugeValue
 		}
 	default:
-		return Metrics{}, ErrUndefinedMetricType
+		return ErrUndefinedMetricType
 	}
 
-	if s.FileRepo != nil && s.FileRepo.Sync() {
-		if err := s.FileRepo.SaveToDisk(metrics); err != nil {
-			log.Printf("Unable to sync Metric to file. \n Metric: %v", metrics)
+	if m.ID == "" {
+		return ErrEmptyMetricID
+	}
+
+	return s.Registry.Validate(m.ID, m.MType)
+}
+
+func (s *Storager) syncToFile() bool {
+	return s.FileRepo != nil && s.FileRepo.Sync()
+}
+
+// journal runs the update and, when every change has to be synced to file,
+// records the resulting metric values in the write-ahead log of the file repository.
+// A failure to write the log is logged and doesn't fail the update.
+func (s *Storager) journal(update func() ([]Metrics, error)) error {
+	if !s.syncToFile() {
+		_, err := update()
+		return err
+	}
+
+	var updateErr error
+	err := s.FileRepo.AppendToLog(func() ([]Metrics, error) {
+		m, err := update()
+		updateErr = err
+		return m, err
+	})
+	if updateErr != nil {
+		return updateErr
+	}
+	if err != nil {
+		log.Printf("Unable to sync Metrics to file. \n Error: %v", err)
+	}
+	return nil
+}
+
+// forward hands the metrics to the forwarders without their hashes,
+// which forwarders compute with the key of their destination.
+func (s *Storager) forward(metrics ...Metrics) {
+	if len(s.Forwarders) == 0 {
+		return
+	}
+
+	unsigned := make([]Metrics, len(metrics))
+	for i, m := range metrics {
+		m.Hash = ""
+		unsigned[i] = m
+	}
+	for _, f := range s.Forwarders {
+		f.Forward(unsigned...)
+	}
+}
+
+// currentValues reads back the stored values of the given metrics.
+func (s *Storager) currentValues(ctx context.Context, metrics []Metrics) []Metrics {
+	res := make([]Metrics, 0, len(metrics))
+	seen := make(map[string]bool, len(metrics))
+
+	for _, v := range metrics {
+		key := v.MType + ":" + v.ID
+		if seen[key] {
+			continue
 		}
+		seen[key] = true
+
+		m, err := s.GetMetric(ctx, Metrics{ID: v.ID, MType: v.MType})
+		if err != nil {
+			log.Printf("Unable to read back Metric %v. Error: %v", v, err)
+			continue
+		}
+		m.Hash = ""
+		res = append(res, m)
 	}
-	return metrics, nil
+	return res
 }
 
-func (s *Storager) GetAllMetrics() map[string]string {
-	counterData := s.Repo.GetAllCounterMetrics()
-	gaugeData := s.Repo.GetAllGaugeMetrics()
+// ListMetrics returns all stored gauges followed by all counters, each ordered by ID.
+func (s *Storager) ListMetrics(ctx context.Context) ([]Metrics, error) {
+	gaugeData, err := s.Repo.GetAllGaugeMetrics(ctx)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return nil, storageError(err, ErrStorageFailure)
+	}
+	counterData, err := s.Repo.GetAllCounterMetrics(ctx)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return nil, storageError(err, ErrStorageFailure)
+	}
 
-	data := make(map[string]string)
+	sort.Slice(gaugeData, func(i, j int) bool { return gaugeData[i].ID < gaugeData[j].ID })
+	sort.Slice(counterData, func(i, j int) bool { return counterData[i].ID < counterData[j].ID })
 
-	for _, v := range counterData {
-		data[v.ID] = fmt.Sprintf("%v", *v.Delta)
+	return append(gaugeData, counterData...), nil
+}
+
+// storageError maps expired or canceled contexts to ErrStorageTimeout and
+// ErrStorageCanceled, a missing metric to ErrMetricNotFound and any other error to fallback.
+func storageError(err, fallback error) error {
+	switch {
+	case errors.Is(err, ErrMetricNotFound):
+		return ErrMetricNotFound
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrStorageTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrStorageCanceled
+	default:
+		return fallback
 	}
+}
 
-	for _, v := range gaugeData {
-		data[v.ID] = fmt.Sprintf("%v", *v.Value)
+// Sign returns the hash of a gauge or counter metric with the key, as expected in Metrics.Hash.
+func Sign(m Metrics, key string) string {
+	if m.MType == "counter" {
+		return hash(fmt.Sprintf("%s:counter:%d", m.ID, *m.Delta), key)
 	}
-	return data
+	return hash(fmt.Sprintf("%s:gauge:%f", m.ID, *m.Value), key)
 }
 
 func hash(s, k string) string {
@@ -41,7 +41,6 @@ func NewRouter() *chi.Mux {
 
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
-	r.Use(middleware.RealIP)
 	r.Use(middleware.RequestID)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Compress(9, compressibleContentTypes...))
@@ -0,0 +1,159 @@
+(function () {
+	"use strict";
+
+	var filter = document.getElementById("filter");
+	var status = document.getElementById("status");
+	var refresh = parseInt(document.body.dataset.refresh, 10) || 0;
+
+	// Sort order per table, kept across refreshes: {column, desc}.
+	var sorting = {};
+
+	function rows(table) {
+		return Array.prototype.slice.call(table.tBodies[0].rows);
+	}
+
+	function applyFilter() {
+		var q = filter.value.trim().toLowerCase();
+		document.querySelectorAll("section").forEach(function (section) {
+			var table = section.querySelector("table");
+			if (!table) {
+				return;
+			}
+			var shown = 0;
+			rows(table).forEach(function (tr) {
+				var match = tr.dataset.name.toLowerCase().indexOf(q) !== -1;
+				tr.classList.toggle("hidden", !match);
+				if (match) {
+					shown++;
+				}
+			});
+			section.querySelector(".count").textContent = "(" + shown + ")";
+		});
+	}
+
+	function key(tr, column) {
+		var v = tr.dataset[column];
+		if (column === "name") {
+			return v.toLowerCase();
+		}
+		return v === "" ? -Infinity : parseFloat(v);
+	}
+
+	function applySort(table) {
+		var s = sorting[table.id];
+		table.querySelectorAll("th[data-sort]").forEach(function (th) {
+			th.classList.toggle("asc", !!s && th.dataset.sort === s.column && !s.desc);
+			th.classList.toggle("desc", !!s && th.dataset.sort === s.column && s.desc);
+		});
+		if (!s) {
+			return;
+		}
+		var body = table.tBodies[0];
+		rows(table)
+			.sort(function (a, b) {
+				var x = key(a, s.column), y = key(b, s.column);
+				var c = x < y ? -1 : x > y ? 1 : 0;
+				return s.desc ? -c : c;
+			})
+			.forEach(function (tr) {
+				body.appendChild(tr);
+			});
+	}
+
+	function ago(ms) {
+		var s = Math.max(0, Math.round((Date.now() - ms) / 1000));
+		if (s < 60) {
+			return s + "s ago";
+		}
+		if (s < 3600) {
+			return Math.floor(s / 60) + "m ago";
+		}
+		if (s < 86400) {
+			return Math.floor(s / 3600) + "h ago";
+		}
+		return new Date(ms).toLocaleString();
+	}
+
+	function renderTimes() {
+		document.querySelectorAll("tr[data-updated]").forEach(function (tr) {
+			var cell = tr.querySelector("td.updated");
+			var ms = parseInt(tr.dataset.updated, 10);
+			cell.textContent = ms ? ago(ms) : "—";
+			cell.title = ms ? new Date(ms).toLocaleString() : "";
+		});
+	}
+
+	function bind() {
+		document.querySelectorAll("table").forEach(function (table) {
+			table.querySelectorAll("th[data-sort]").forEach(function (th) {
+				th.addEventListener("click", function () {
+					var s = sorting[table.id];
+					var column = th.dataset.sort;
+					sorting[table.id] = {
+						column: column,
+						desc: !!s && s.column === column && !s.desc,
+					};
+					applySort(table);
+				});
+			});
+			applySort(table);
+		});
+		applyFilter();
+		renderTimes();
+	}
+
+	function reload() {
+		fetch(window.location.pathname, { cache: "no-store" })
+			.then(function (resp) {
+				if (!resp.ok) {
+					throw new Error(resp.status + " " + resp.statusText);
+				}
+				return resp.text();
+			})
+			.then(function (html) {
+				var doc = new DOMParser().parseFromString(html, "text/html");
+				document.querySelector("main").replaceWith(doc.querySelector("main"));
+				bind();
+				status.textContent = "Refreshed " + new Date().toLocaleTimeString();
+			})
+			.catch(function (err) {
+				status.textContent = "Refresh failed: " + err.message;
+			});
+	}
+
+	// Apply updates pushed by the server between refreshes. Metrics that aren't
+	// on the page yet show up with the next refresh.
+	function live() {
+		var source = new EventSource("/stream");
+		source.addEventListener("metric", function (e) {
+			var m = JSON.parse(e.data);
+			var table = document.getElementById(m.type);
+			if (!table) {
+				return;
+			}
+			var tr = rows(table).filter(function (r) {
+				return r.dataset.name === m.id;
+			})[0];
+			if (!tr) {
+				return;
+			}
+			var v = m.type === "gauge" ? m.value : m.delta;
+			tr.dataset.value = v;
+			tr.dataset.updated = Date.now();
+			tr.querySelector("td.value").textContent = v;
+		});
+	}
+
+	filter.addEventListener("input", applyFilter);
+	bind();
+
+	if (window.EventSource) {
+		live();
+	}
+
+	if (refresh > 0) {
+		status.textContent = "Auto-refresh every " + refresh + "s";
+		setInterval(reload, refresh * 1000);
+	}
+	setInterval(renderTimes, 1000);
+})();
@@ -0,0 +1,45 @@
+// Package static holds the web assets and page templates served by the server.
+package static
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+)
+
+// Assets are the stylesheets and scripts of the dashboard, served under /static/.
+//
+//go:embed assets
+var Assets embed.FS
+
+//go:embed html
+var templates embed.FS
+
+// Templates parses the embedded page templates. When dir is set, *.html files found
+// there replace the embedded templates of the same name, so pages can be customised
+// without rebuilding the server.
+func Templates(dir string) (*template.Template, error) {
+	t, err := template.ParseFS(templates, "html/*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	if dir == "" {
+		return t, nil
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("template directory: %w", err)
+	}
+	overrides, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(overrides) == 0 {
+		return t, nil
+	}
+
+	return t.ParseFiles(overrides...)
+}
@@ -0,0 +1,257 @@
+package boltstorage
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Scheme selects the embedded key-value store in DATABASE_DSN, e.g. bolt:///var/lib/metricity/metrics.bolt.
+const Scheme = "bolt://"
+
+var (
+	gaugeBucket   = []byte("gauge")
+	counterBucket = []byte("counter")
+)
+
+// BoltRepo keeps every metric under its own key in an embedded bbolt file, one bucket
+// per metric type, with the value encoded as 8 bytes. Each write is committed with
+// fsync before it returns, so unlike MemStorage it needs no separate file snapshots.
+// Concurrent single-metric updates are coalesced into shared transactions by bolt's
+// Batch to keep up with many agents reporting at once.
+type BoltRepo struct {
+	DB *bolt.DB
+}
+
+// ParseDSN returns the database file path if dsn uses the bolt:// scheme.
+func ParseDSN(dsn string) (string, bool) {
+	if !strings.HasPrefix(dsn, Scheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(dsn, Scheme), true
+}
+
+func NewRepository(path string) (*BoltRepo, error) {
+	if path == "" {
+		return nil, fmt.Errorf("bolt database path is empty")
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{gaugeBucket, counterBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltRepo{DB: db}, nil
+}
+
+func (b *BoltRepo) Close() error {
+	return b.DB.Close()
+}
+
+func (b *BoltRepo) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.DB.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(gaugeBucket) == nil || tx.Bucket(counterBucket) == nil {
+			return fmt.Errorf("bolt database %s is not initialised", b.DB.Path())
+		}
+		return nil
+	})
+}
+
+func (b *BoltRepo) UpdateGaugeMetrics(ctx context.Context, name, value string) error {
+	g, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("unable to parse value to gauge. value: %v, error: %v", value, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return b.DB.Batch(func(tx *bolt.Tx) error {
+		return putGauge(tx, name, g)
+	})
+}
+
+func (b *BoltRepo) UpdateCounterMetrics(ctx context.Context, name, value string) (int64, error) {
+	g, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse value to counter. value: %v, error: %v", value, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var v int64
+	err = b.DB.Batch(func(tx *bolt.Tx) error {
+		// Batch may run the function again if another one in the same transaction
+		// fails, so the result is only taken from the last, committed run.
+		var err error
+		v, err = addCounter(tx, name, g)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return v, nil
+}
+
+// UpdateBatchMetrics applies the whole batch in one transaction: either all
+// metrics are written or none of them.
+func (b *BoltRepo) UpdateBatchMetrics(ctx context.Context, metrics []repositories.Metrics) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		for _, v := range metrics {
+			switch v.MType {
+			case "gauge":
+				if v.Value == nil {
+					return fmt.Errorf("gauge %s has no value", v.ID)
+				}
+				if err := putGauge(tx, v.ID, *v.Value); err != nil {
+					return err
+				}
+			case "counter":
+				if v.Delta == nil {
+					return fmt.Errorf("counter %s has no delta", v.ID)
+				}
+				if _, err := addCounter(tx, v.ID, *v.Delta); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltRepo) GetGaugeMetrics(ctx context.Context, name string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	var (
+		raw uint64
+		ok  bool
+	)
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		raw, ok = get(tx, gaugeBucket, name)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to get stored gauge value: %w", err)
+	}
+	if !ok {
+		return "", fmt.Errorf("%w: gauge %s", repositories.ErrMetricNotFound, name)
+	}
+
+	return fmt.Sprintf("%v", math.Float64frombits(raw)), nil
+}
+
+func (b *BoltRepo) GetCounterMetrics(ctx context.Context, name string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	var (
+		raw uint64
+		ok  bool
+	)
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		raw, ok = get(tx, counterBucket, name)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to get stored counter value: %w", err)
+	}
+	if !ok {
+		return "", fmt.Errorf("%w: counter %s", repositories.ErrMetricNotFound, name)
+	}
+
+	return fmt.Sprintf("%v", int64(raw)), nil
+}
+
+func (b *BoltRepo) GetAllGaugeMetrics(ctx context.Context) ([]repositories.Metrics, error) {
+	return b.getAll(ctx, gaugeBucket, func(id string, raw uint64) repositories.Metrics {
+		v := math.Float64frombits(raw)
+		return repositories.Metrics{ID: id, MType: "gauge", Value: &v}
+	})
+}
+
+func (b *BoltRepo) GetAllCounterMetrics(ctx context.Context) ([]repositories.Metrics, error) {
+	return b.getAll(ctx, counterBucket, func(id string, raw uint64) repositories.Metrics {
+		v := int64(raw)
+		return repositories.Metrics{ID: id, MType: "counter", Delta: &v}
+	})
+}
+
+func (b *BoltRepo) getAll(ctx context.Context, bucket []byte, decode func(id string, raw uint64) repositories.Metrics) ([]repositories.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	res := []repositories.Metrics{}
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			if len(v) != 8 {
+				return fmt.Errorf("corrupt %s value for %s", bucket, k)
+			}
+			res = append(res, decode(string(k), binary.BigEndian.Uint64(v)))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func get(tx *bolt.Tx, bucket []byte, name string) (uint64, bool) {
+	v := tx.Bucket(bucket).Get([]byte(name))
+	if len(v) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(v), true
+}
+
+func put(tx *bolt.Tx, bucket []byte, name string, raw uint64) error {
+	if name == "" {
+		return repositories.ErrEmptyMetricID
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, raw)
+	return tx.Bucket(bucket).Put([]byte(name), v)
+}
+
+func putGauge(tx *bolt.Tx, name string, value float64) error {
+	return put(tx, gaugeBucket, name, math.Float64bits(value))
+}
+
+func addCounter(tx *bolt.Tx, name string, delta int64) (int64, error) {
+	old, _ := get(tx, counterBucket, name)
+	v := int64(old) + delta
+	return v, put(tx, counterBucket, name, uint64(v))
+}
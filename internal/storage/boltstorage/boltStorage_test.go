@@ -0,0 +1,84 @@
+package boltstorage
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+	"github.com/fkocharli/metricity/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltRepo(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.bolt")
+
+	b, err := NewRepository(path)
+	require.NoError(t, err)
+
+	require.NoError(t, b.UpdateGaugeMetrics(ctx, "Alloc", "1.5"))
+
+	const (
+		workers    = 8
+		increments = 50
+	)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				_, err := b.UpdateCounterMetrics(ctx, "PollCount", "1")
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, delta := float64(-2.5), int64(10)
+	require.NoError(t, b.UpdateBatchMetrics(ctx, []repositories.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &value},
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+	}))
+
+	// A broken batch is rolled back as a whole.
+	assert.Error(t, b.UpdateBatchMetrics(ctx, []repositories.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "Frees", MType: "gauge"},
+	}))
+
+	require.NoError(t, b.Close())
+
+	b, err = NewRepository(path)
+	require.NoError(t, err)
+	defer b.Close()
+
+	g, err := b.GetGaugeMetrics(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, "-2.5", g)
+
+	c, err := b.GetCounterMetrics(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, "410", c)
+
+	_, err = b.GetGaugeMetrics(ctx, "Frees")
+	assert.ErrorIs(t, err, repositories.ErrMetricNotFound)
+
+	gauges, err := b.GetAllGaugeMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []repositories.Metrics{{ID: "Alloc", MType: "gauge", Value: &value}}, gauges)
+
+	assert.NoError(t, b.Ping(ctx))
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) repositories.Storage {
+		b, err := NewRepository(filepath.Join(t.TempDir(), "metrics.bolt"))
+		require.NoError(t, err)
+		t.Cleanup(func() { b.Close() })
+		return b
+	})
+}
@@ -0,0 +1,200 @@
+package cachedstorage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+	"github.com/fkocharli/metricity/internal/storage/memorystorage"
+)
+
+// CachedRepo serves reads and writes from memory and flushes the changes to the
+// backend storage (Postgres) in batches every FlushInterval (write-behind).
+// Counter deltas accumulated between flushes are summed, for gauges only the last value is sent.
+type CachedRepo struct {
+	Cache           *memorystorage.MemStorage
+	Backend         repositories.Storage
+	FlushInterval   time.Duration
+	PendingMutex    *sync.Mutex
+	pendingGauges   map[string]float64
+	pendingCounters map[string]int64
+}
+
+// NewRepository warms the cache up with the current contents of the backend.
+func NewRepository(ctx context.Context, backend repositories.Storage, interval time.Duration) (*CachedRepo, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("cache flush interval must be positive, got %v", interval)
+	}
+
+	c := &CachedRepo{
+		Cache:           memorystorage.NewRepository(),
+		Backend:         backend,
+		FlushInterval:   interval,
+		PendingMutex:    &sync.Mutex{},
+		pendingGauges:   make(map[string]float64),
+		pendingCounters: make(map[string]int64),
+	}
+
+	gauges, err := backend.GetAllGaugeMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range gauges {
+		if err := c.Cache.UpdateGaugeMetrics(ctx, v.ID, fmt.Sprintf("%v", *v.Value)); err != nil {
+			return nil, err
+		}
+	}
+
+	counters, err := backend.GetAllCounterMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range counters {
+		if _, err := c.Cache.UpdateCounterMetrics(ctx, v.ID, fmt.Sprintf("%v", *v.Delta)); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Run flushes pending changes on every tick and once more when ctx is cancelled.
+func (c *CachedRepo) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Flush(ctx); err != nil {
+				log.Printf("Unable to flush cached metrics. Error: %v", err)
+			}
+		case <-ctx.Done():
+			log.Println("Flushing cached metrics")
+			flushCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			defer cancel()
+			return c.Flush(flushCtx)
+		}
+	}
+}
+
+// Flush writes pending changes to the backend. On failure they are kept
+// and retried on the next flush.
+func (c *CachedRepo) Flush(ctx context.Context) error {
+	c.PendingMutex.Lock()
+	gauges, counters := c.pendingGauges, c.pendingCounters
+	c.pendingGauges = make(map[string]float64)
+	c.pendingCounters = make(map[string]int64)
+	c.PendingMutex.Unlock()
+
+	if len(gauges) == 0 && len(counters) == 0 {
+		return nil
+	}
+
+	batch := make([]repositories.Metrics, 0, len(gauges)+len(counters))
+	for k, v := range gauges {
+		v := v
+		batch = append(batch, repositories.Metrics{ID: k, MType: "gauge", Value: &v})
+	}
+	for k, v := range counters {
+		v := v
+		batch = append(batch, repositories.Metrics{ID: k, MType: "counter", Delta: &v})
+	}
+
+	if err := c.Backend.UpdateBatchMetrics(ctx, batch); err != nil {
+		c.PendingMutex.Lock()
+		defer c.PendingMutex.Unlock()
+
+		for k, v := range gauges {
+			if _, ok := c.pendingGauges[k]; !ok {
+				c.pendingGauges[k] = v
+			}
+		}
+		for k, v := range counters {
+			c.pendingCounters[k] += v
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (c *CachedRepo) UpdateGaugeMetrics(ctx context.Context, name, value string) error {
+	g, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("unable to parse value to gauge. value: %v, error: %v", value, err)
+	}
+
+	c.PendingMutex.Lock()
+	defer c.PendingMutex.Unlock()
+
+	if err := c.Cache.UpdateGaugeMetrics(ctx, name, value); err != nil {
+		return err
+	}
+	c.pendingGauges[name] = g
+
+	return nil
+}
+
+func (c *CachedRepo) UpdateCounterMetrics(ctx context.Context, name, value string) (int64, error) {
+	g, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse value to counter. value: %v, error: %v", value, err)
+	}
+
+	c.PendingMutex.Lock()
+	defer c.PendingMutex.Unlock()
+
+	v, err := c.Cache.UpdateCounterMetrics(ctx, name, value)
+	if err != nil {
+		return 0, err
+	}
+	c.pendingCounters[name] += g
+
+	return v, nil
+}
+
+// UpdateBatchMetrics applies the batch to the cache as a whole, so an invalid
+// metric leaves both the cache and the pending changes untouched.
+func (c *CachedRepo) UpdateBatchMetrics(ctx context.Context, metrics []repositories.Metrics) error {
+	c.PendingMutex.Lock()
+	defer c.PendingMutex.Unlock()
+
+	if err := c.Cache.UpdateBatchMetrics(ctx, metrics); err != nil {
+		return err
+	}
+
+	for _, v := range metrics {
+		switch v.MType {
+		case "counter":
+			c.pendingCounters[v.ID] += *v.Delta
+		case "gauge":
+			c.pendingGauges[v.ID] = *v.Value
+		}
+	}
+	return nil
+}
+
+func (c *CachedRepo) GetGaugeMetrics(ctx context.Context, name string) (string, error) {
+	return c.Cache.GetGaugeMetrics(ctx, name)
+}
+
+func (c *CachedRepo) GetCounterMetrics(ctx context.Context, name string) (string, error) {
+	return c.Cache.GetCounterMetrics(ctx, name)
+}
+
+func (c *CachedRepo) GetAllGaugeMetrics(ctx context.Context) ([]repositories.Metrics, error) {
+	return c.Cache.GetAllGaugeMetrics(ctx)
+}
+
+func (c *CachedRepo) GetAllCounterMetrics(ctx context.Context) ([]repositories.Metrics, error) {
+	return c.Cache.GetAllCounterMetrics(ctx)
+}
+
+func (c *CachedRepo) Ping(ctx context.Context) error {
+	return c.Backend.Ping(ctx)
+}
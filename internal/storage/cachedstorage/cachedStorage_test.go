@@ -0,0 +1,77 @@
+package cachedstorage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+	"github.com/fkocharli/metricity/internal/storage/memorystorage"
+	"github.com/fkocharli/metricity/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingBackend struct {
+	*memorystorage.MemStorage
+	batches [][]repositories.Metrics
+	fail    bool
+}
+
+func (r *recordingBackend) UpdateBatchMetrics(ctx context.Context, metrics []repositories.Metrics) error {
+	if r.fail {
+		return errors.New("backend is down")
+	}
+	r.batches = append(r.batches, metrics)
+	return nil
+}
+
+func TestWriteBehind(t *testing.T) {
+	ctx := context.Background()
+	backend := &recordingBackend{MemStorage: memorystorage.NewRepository()}
+	_, err := backend.MemStorage.UpdateCounterMetrics(ctx, "PollCount", "10")
+	require.NoError(t, err)
+
+	c, err := NewRepository(ctx, backend, time.Second)
+	require.NoError(t, err)
+
+	_, err = NewRepository(ctx, backend, 0)
+	assert.Error(t, err)
+
+	v, err := c.UpdateCounterMetrics(ctx, "PollCount", "5")
+	require.NoError(t, err)
+	assert.Equal(t, int64(15), v)
+	require.NoError(t, c.UpdateGaugeMetrics(ctx, "Alloc", "1"))
+	require.NoError(t, c.UpdateGaugeMetrics(ctx, "Alloc", "2"))
+
+	assert.Empty(t, backend.batches)
+
+	backend.fail = true
+	assert.Error(t, c.Flush(ctx))
+
+	_, err = c.UpdateCounterMetrics(ctx, "PollCount", "1")
+	require.NoError(t, err)
+
+	backend.fail = false
+	require.NoError(t, c.Flush(ctx))
+	require.Len(t, backend.batches, 1)
+
+	flushed := map[string]repositories.Metrics{}
+	for _, m := range backend.batches[0] {
+		flushed[m.ID] = m
+	}
+	assert.Equal(t, int64(6), *flushed["PollCount"].Delta)
+	assert.Equal(t, float64(2), *flushed["Alloc"].Value)
+
+	require.NoError(t, c.Flush(ctx))
+	assert.Len(t, backend.batches, 1)
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) repositories.Storage {
+		c, err := NewRepository(context.Background(), memorystorage.NewRepository(), time.Second)
+		require.NoError(t, err)
+		return c
+	})
+}
@@ -0,0 +1,71 @@
+package dbstorage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+	"github.com/fkocharli/metricity/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	_ "github.com/lib/pq"
+)
+
+// testRepo connects to the database given by TEST_DATABASE_DSN or skips the test.
+func testRepo(t *testing.T) *PostgreRepo {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	p, err := NewRepository(db, 5*time.Second)
+	require.NoError(t, err)
+	return p
+}
+
+func TestNoLostCounterUpdatesAcrossReplicas(t *testing.T) {
+	storagetest.RunReplicas(t, func(t *testing.T) repositories.Storage {
+		return testRepo(t)
+	})
+}
+
+func TestSeedMetricsKeepsStoredValues(t *testing.T) {
+	ctx := context.Background()
+	p := testRepo(t)
+
+	counter := fmt.Sprintf("SeedCounter%d", time.Now().UnixNano())
+	gauge := fmt.Sprintf("SeedGauge%d", time.Now().UnixNano())
+	_, err := p.UpdateCounterMetrics(ctx, counter, "10")
+	require.NoError(t, err)
+
+	snapshotCount, snapshotValue := int64(3), float64(1.5)
+	require.NoError(t, p.SeedMetrics(ctx, []repositories.Metrics{
+		{ID: counter, MType: "counter", Delta: &snapshotCount},
+		{ID: gauge, MType: "gauge", Value: &snapshotValue},
+	}))
+
+	c, err := p.GetCounterMetrics(ctx, counter)
+	require.NoError(t, err)
+	assert.Equal(t, "10", c)
+
+	g, err := p.GetGaugeMetrics(ctx, gauge)
+	require.NoError(t, err)
+	assert.Equal(t, "1.5", g)
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) repositories.Storage {
+		return testRepo(t)
+	})
+}
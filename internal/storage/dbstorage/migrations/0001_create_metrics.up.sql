@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS metrics (
+    metricID VARCHAR(50) UNIQUE NOT NULL,
+    type     VARCHAR(20),
+    counter  BIGINT,
+    gauge    DOUBLE PRECISION
+);
@@ -0,0 +1 @@
+ALTER TABLE metrics ALTER COLUMN metricID TYPE TEXT;
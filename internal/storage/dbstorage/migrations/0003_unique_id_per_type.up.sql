@@ -0,0 +1,2 @@
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_metricid_key;
+ALTER TABLE metrics ADD CONSTRAINT metrics_metricid_type_key UNIQUE (metricID, type);
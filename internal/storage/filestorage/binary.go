@@ -0,0 +1,144 @@
+package filestorage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+)
+
+// Binary snapshot layout, all integers little endian:
+//
+//	header:  magic "MTRC" | version uint16 | reserved uint16 | record count uint32
+//	record:  length uint32 | type uint8 | id length uint16 | id | value 8 bytes
+//	trailer: CRC-32 (Castagnoli) of everything before it
+//
+// Gauge values are stored as IEEE 754 bits, counter deltas as int64.
+const (
+	FormatJSON   = "json"
+	FormatBinary = "binary"
+
+	binaryVersion = 1
+
+	recordGauge   = 1
+	recordCounter = 2
+)
+
+var (
+	binaryMagic = []byte("MTRC")
+	crcTable    = crc32.MakeTable(crc32.Castagnoli)
+
+	ErrUnsupportedVersion = errors.New("unsupported binary snapshot version")
+	ErrChecksumMismatch   = errors.New("binary snapshot checksum mismatch")
+	ErrCorruptSnapshot    = errors.New("corrupt binary snapshot")
+)
+
+func isBinarySnapshot(b []byte) bool {
+	return bytes.HasPrefix(b, binaryMagic)
+}
+
+func encodeBinary(w io.Writer, metrics []repositories.Metrics) error {
+	var buf bytes.Buffer
+
+	buf.Write(binaryMagic)
+	binary.Write(&buf, binary.LittleEndian, uint16(binaryVersion))
+	binary.Write(&buf, binary.LittleEndian, uint16(0))
+
+	records := make([]repositories.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		if (m.MType == "gauge" && m.Value != nil) || (m.MType == "counter" && m.Delta != nil) {
+			records = append(records, m)
+		}
+	}
+	binary.Write(&buf, binary.LittleEndian, uint32(len(records)))
+
+	for _, m := range records {
+		if len(m.ID) > math.MaxUint16 {
+			return fmt.Errorf("metric id is too long: %d bytes", len(m.ID))
+		}
+
+		binary.Write(&buf, binary.LittleEndian, uint32(1+2+len(m.ID)+8))
+
+		var value uint64
+		switch m.MType {
+		case "gauge":
+			buf.WriteByte(recordGauge)
+			value = math.Float64bits(*m.Value)
+		case "counter":
+			buf.WriteByte(recordCounter)
+			value = uint64(*m.Delta)
+		}
+
+		binary.Write(&buf, binary.LittleEndian, uint16(len(m.ID)))
+		buf.WriteString(m.ID)
+		binary.Write(&buf, binary.LittleEndian, value)
+	}
+
+	binary.Write(&buf, binary.LittleEndian, crc32.Checksum(buf.Bytes(), crcTable))
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func decodeBinary(b []byte) ([]repositories.Metrics, error) {
+	const headerSize = 4 + 2 + 2 + 4
+	if len(b) < headerSize+4 {
+		return nil, ErrCorruptSnapshot
+	}
+
+	body, sum := b[:len(b)-4], binary.LittleEndian.Uint32(b[len(b)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return nil, ErrChecksumMismatch
+	}
+
+	if v := binary.LittleEndian.Uint16(body[4:6]); v != binaryVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, v)
+	}
+	count := binary.LittleEndian.Uint32(body[8:12])
+
+	res := make([]repositories.Metrics, 0, count)
+	r := body[headerSize:]
+
+	for i := uint32(0); i < count; i++ {
+		if len(r) < 4 {
+			return nil, ErrCorruptSnapshot
+		}
+		size := binary.LittleEndian.Uint32(r)
+		r = r[4:]
+		if uint32(len(r)) < size || size < 1+2+8 {
+			return nil, ErrCorruptSnapshot
+		}
+		rec := r[:size]
+		r = r[size:]
+
+		idLen := int(binary.LittleEndian.Uint16(rec[1:3]))
+		if len(rec) != 1+2+idLen+8 {
+			return nil, ErrCorruptSnapshot
+		}
+
+		m := repositories.Metrics{ID: string(rec[3 : 3+idLen])}
+		value := binary.LittleEndian.Uint64(rec[3+idLen:])
+
+		switch rec[0] {
+		case recordGauge:
+			v := math.Float64frombits(value)
+			m.MType, m.Value = "gauge", &v
+		case recordCounter:
+			v := int64(value)
+			m.MType, m.Delta = "counter", &v
+		default:
+			return nil, ErrCorruptSnapshot
+		}
+		res = append(res, m)
+	}
+
+	if len(r) != 0 {
+		return nil, ErrCorruptSnapshot
+	}
+	return res, nil
+}
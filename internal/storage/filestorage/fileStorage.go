@@ -1,45 +1,82 @@
 package filestorage
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/fkocharli/metricity/internal/atomicfile"
 	"github.com/fkocharli/metricity/internal/repositories"
 )
 
+// FileStore keeps metrics snapshots on disk. Every snapshot is written to a temporary
+// file, synced and renamed over Path, so the file is always either the old or the new
+// snapshot. Up to Keep previous snapshots are kept as Path.1 ... Path.N; the current one
+// is hard-linked to Path.1 before it is replaced, so Path never goes missing.
+//
+// In sync mode (StoreInterval == 0) every update is appended to the write-ahead log
+// Path.wal instead of rewriting the snapshot. The log is truncated on compaction.
+//
+// Snapshots are written in Format (json or binary). The format of existing files is
+// detected on load, so switching formats migrates the file on the next snapshot.
 type FileStore struct {
-	FileReader    *os.File
-	Decoder       *json.Decoder
-	FileWriter    *os.File
-	Encoder       *json.Encoder
+	Path          string
+	Keep          int
+	Format        string
 	FileMutex     *sync.RWMutex
 	StoreInterval time.Duration
+	LogMutex      *sync.Mutex
+	Log           *os.File
 }
 
-func NewRepository(path string, s time.Duration) (*FileStore, error) {
+func NewRepository(path string, s time.Duration, keep int, format string) (*FileStore, error) {
 	if path != "" {
-		r, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0777)
-		if err != nil {
+		if _, err := os.Stat(filepath.Dir(path)); err != nil {
 			return nil, err
 		}
 
-		w, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0777)
-		if err != nil {
-			return nil, err
+		switch format {
+		case "":
+			format = FormatJSON
+		case FormatJSON, FormatBinary:
+		default:
+			return nil, fmt.Errorf("unknown store format: %q", format)
 		}
 
-		return &FileStore{
-			FileReader:    r,
-			Decoder:       json.NewDecoder(r),
-			FileWriter:    w,
-			Encoder:       json.NewEncoder(w),
+		if keep < 0 {
+			keep = 0
+		}
+
+		f := &FileStore{
+			Path:          path,
+			Keep:          keep,
+			Format:        format,
 			FileMutex:     &sync.RWMutex{},
 			StoreInterval: s,
-		}, nil
+			LogMutex:      &sync.Mutex{},
+		}
+
+		if f.Sync() {
+			l, err := os.OpenFile(f.logPath(), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				return nil, err
+			}
+			if err := repairLog(l); err != nil {
+				l.Close()
+				return nil, err
+			}
+			f.Log = l
+		}
+
+		return f, nil
 
 	}
 	return nil, nil
@@ -49,92 +86,271 @@ func (f *FileStore) Sync() bool {
 	return f.StoreInterval == 0
 }
 
-func (f *FileStore) SaveAllToDisk(m []repositories.Metrics) error {
+// SaveAllToDisk writes the state returned by snapshot and truncates the write-ahead log.
+// Appends are blocked meanwhile, so every update is either in the snapshot or in the log.
+// Nothing is written when snapshot fails.
+func (f *FileStore) SaveAllToDisk(snapshot func() ([]repositories.Metrics, error)) error {
+	f.LogMutex.Lock()
+	defer f.LogMutex.Unlock()
+
 	f.FileMutex.Lock()
 	defer f.FileMutex.Unlock()
 
-	f.FileWriter.Seek(0, 0)
-	f.FileWriter.Truncate(0)
-
-	f.Encoder.SetIndent("", "    ")
-	if err := f.Encoder.Encode(m); err != nil {
+	m, err := snapshot()
+	if err != nil {
+		log.Printf("Unable to read Metrics for snapshot. \n Error: %v", err)
+		return err
+	}
+	if err := f.writeSnapshot(m); err != nil {
 		log.Printf("Unable to save to file Metrics. \n Metrics: %v \n Error: %v", m, err)
 		return err
 	}
+
+	if err := f.truncateLog(); err != nil {
+		log.Printf("Unable to truncate write-ahead log. \n Error: %v", err)
+		return err
+	}
 	return nil
 }
 
-func (f *FileStore) SaveToDisk(m repositories.Metrics) error {
-	f.FileMutex.Lock()
-	defer f.FileMutex.Unlock()
+// AppendToLog runs update and appends the metric values it returns to the write-ahead log.
+// Updates are serialised, so the log order matches the order they were applied in.
+func (f *FileStore) AppendToLog(update func() ([]repositories.Metrics, error)) error {
+	f.LogMutex.Lock()
+	defer f.LogMutex.Unlock()
 
-	var x []repositories.Metrics
+	m, err := update()
+	if err != nil {
+		return err
+	}
+	if len(m) == 0 {
+		return nil
+	}
 
-	f.FileReader.Seek(0, 0)
+	if f.Log == nil {
+		return errors.New("write-ahead log is not open")
+	}
 
-	for f.Decoder.More() {
-		err := f.Decoder.Decode(&x)
-		if err != io.EOF && err != nil {
-			log.Printf("Unable to save to file Metric: %v \n Error: %v", m, err)
-			return err
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if _, err := f.Log.Write(b); err != nil {
+		return err
+	}
+	return f.Log.Sync()
+}
+
+// LoadLog returns the metric values recorded in the write-ahead log in the order they were
+// written. Torn records, left by a crash mid-append, are skipped.
+func (f *FileStore) LoadLog() ([]repositories.Metrics, error) {
+	f.FileMutex.RLock()
+	defer f.FileMutex.RUnlock()
+
+	r, err := os.Open(f.logPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var res []repositories.Metrics
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var m []repositories.Metrics
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			log.Printf("Skipping corrupt write-ahead log record. \n Error: %v", err)
+			continue
 		}
+		res = append(res, m...)
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (f *FileStore) LoadFromDisk() ([]repositories.Metrics, error) {
+	f.FileMutex.RLock()
+	defer f.FileMutex.RUnlock()
+
+	return f.load()
+}
+
+func (f *FileStore) Close() error {
+	f.LogMutex.Lock()
+	defer f.LogMutex.Unlock()
+
+	if f.Log == nil {
+		return nil
+	}
+	err := f.Log.Close()
+	f.Log = nil
+	return err
+}
 
-	metricExist := false
-	if len(x) > 0 {
-		for i, v := range x {
-			if v.ID == m.ID {
-				switch v.MType {
-				case "counter":
-					*x[i].Delta = *m.Delta
-				case "gauge":
-					*x[i].Value = *m.Value
-				}
-				metricExist = true
-				break
+// load returns the newest snapshot that can be decoded, falling back to older
+// ones when the current file is missing or corrupt.
+func (f *FileStore) load() ([]repositories.Metrics, error) {
+	var firstErr error
+	for i := 0; i <= f.Keep; i++ {
+		m, format, err := readSnapshot(f.snapshotPath(i))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Unable to read from file Metrics. \n File: %s \n Error: %v", f.snapshotPath(i), err)
+			if firstErr == nil {
+				firstErr = err
 			}
+			continue
+		}
+		if i > 0 {
+			log.Printf("Restored Metrics from previous snapshot %s", f.snapshotPath(i))
+		}
+		if format != f.Format && len(m) > 0 {
+			log.Printf("Snapshot %s is in %s format, it will be migrated to %s on next save", f.snapshotPath(i), format, f.Format)
 		}
+		return m, nil
 	}
-	if !metricExist {
-		x = append(x, m)
+
+	if firstErr != nil {
+		return nil, fmt.Errorf("no valid snapshot found: %w", firstErr)
 	}
+	return nil, nil
+}
 
-	f.FileWriter.Seek(0, 0)
-	f.FileWriter.Truncate(0)
+func (f *FileStore) snapshotPath(i int) string {
+	if i == 0 {
+		return f.Path
+	}
+	return fmt.Sprintf("%s.%d", f.Path, i)
+}
 
-	f.Encoder.SetIndent("", "    ")
+func (f *FileStore) logPath() string {
+	return f.Path + ".wal"
+}
 
-	if err := f.Encoder.Encode(x); err != nil {
-		log.Printf("Unable to save to file Metric. \n Metric: %v \n Error: %v", m, err)
+func (f *FileStore) truncateLog() error {
+	if f.Log == nil {
+		err := os.Remove(f.logPath())
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
 		return err
 	}
-	return nil
 
+	if err := f.Log.Truncate(0); err != nil {
+		return err
+	}
+	return f.Log.Sync()
 }
 
-func (f *FileStore) LoadFromDisk() ([]repositories.Metrics, error) {
-	f.FileMutex.RLock()
-	defer f.FileMutex.RUnlock()
+// repairLog cuts a torn record, left by a crash mid-append, off the end of the log,
+// so records appended from now on start on a line of their own whether or not the
+// log is replayed.
+func repairLog(l *os.File) error {
+	info, err := l.Stat()
+	if err != nil {
+		return err
+	}
 
-	f.FileReader.Seek(0, 0)
+	size := info.Size()
+	buf := make([]byte, 4096)
+	for end := size; end > 0; {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err := l.ReadAt(chunk, start); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			return truncateLogAt(l, start+int64(i)+1, size)
+		}
+		end = start
+	}
+	return truncateLogAt(l, 0, size)
+}
 
-	var m []repositories.Metrics
+func truncateLogAt(l *os.File, offset, size int64) error {
+	if offset == size {
+		return nil
+	}
+	log.Printf("Cutting torn record off write-ahead log %s at offset %d", l.Name(), offset)
+	if err := l.Truncate(offset); err != nil {
+		return err
+	}
+	return l.Sync()
+}
 
-	for f.Decoder.More() {
-		err := f.Decoder.Decode(&m)
-		if err != io.EOF && err != nil {
-			log.Printf("Unable to read from file Metrics. \n Error: %v", err)
-			return nil, err
+func (f *FileStore) writeSnapshot(m []repositories.Metrics) error {
+	return atomicfile.Write(f.Path, func(w io.Writer) error {
+		return f.encode(w, m)
+	}, f.rotate)
+}
+
+// rotate shifts Path.1 -> ... -> Path.Keep, dropping the oldest one, and links Path
+// to Path.1. Path itself stays in place until the new snapshot is renamed over it.
+func (f *FileStore) rotate() error {
+	if f.Keep == 0 {
+		return nil
+	}
+
+	for i := f.Keep; i > 1; i-- {
+		err := os.Rename(f.snapshotPath(i-1), f.snapshotPath(i))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
 		}
 	}
 
-	return m, nil
+	if err := os.Remove(f.snapshotPath(1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err := os.Link(f.Path, f.snapshotPath(1))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
 }
 
-func (f *FileStore) FileWriterClose() error {
-	return f.FileWriter.Close()
+func (f *FileStore) encode(w io.Writer, m []repositories.Metrics) error {
+	if f.Format == FormatBinary {
+		return encodeBinary(w, m)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(m)
 }
 
-func (f *FileStore) FileReaderClose() error {
-	return f.FileReader.Close()
+// readSnapshot decodes a snapshot detecting its format by the binary magic header.
+func readSnapshot(path string) ([]repositories.Metrics, string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if isBinarySnapshot(b) {
+		m, err := decodeBinary(b)
+		return m, FormatBinary, err
+	}
+
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, FormatJSON, nil
+	}
+
+	var m []repositories.Metrics
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, FormatJSON, err
+	}
+	return m, FormatJSON, nil
 }
@@ -0,0 +1,166 @@
+package filestorage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	f, err := NewRepository(path, 0, 2, FormatJSON)
+	require.NoError(t, err)
+	defer f.Close()
+
+	first, second := float64(1), float64(2)
+	require.NoError(t, f.SaveAllToDisk(snapshot(repositories.Metrics{ID: "Alloc", MType: "gauge", Value: &first})))
+	require.NoError(t, f.SaveAllToDisk(snapshot(repositories.Metrics{ID: "Alloc", MType: "gauge", Value: &second})))
+
+	m, err := f.LoadFromDisk()
+	require.NoError(t, err)
+	require.Len(t, m, 1)
+	assert.Equal(t, second, *m[0].Value)
+
+	// Simulate a torn write of the current snapshot.
+	require.NoError(t, os.WriteFile(path, []byte(`[{"id":"Alloc","ty`), 0644))
+
+	m, err = f.LoadFromDisk()
+	require.NoError(t, err)
+	require.Len(t, m, 1)
+	assert.Equal(t, first, *m[0].Value)
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.NotContains(t, e.Name(), ".tmp-")
+	}
+}
+
+func TestRotateKeepsCurrentSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	f, err := NewRepository(path, time.Minute, 2, FormatJSON)
+	require.NoError(t, err)
+	defer f.Close()
+
+	v := float64(1)
+	require.NoError(t, f.SaveAllToDisk(snapshot(repositories.Metrics{ID: "Alloc", MType: "gauge", Value: &v})))
+	current, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// A crash between rotation and the rename of the new snapshot leaves Path intact.
+	require.NoError(t, f.rotate())
+	for _, p := range []string{path, path + ".1"} {
+		b, err := os.ReadFile(p)
+		require.NoError(t, err)
+		assert.Equal(t, current, b)
+	}
+}
+
+func TestWriteAheadLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	f, err := NewRepository(path, 0, 1, FormatJSON)
+	require.NoError(t, err)
+	defer f.Close()
+
+	gaugeValue, first, second := float64(3), int64(5), int64(8)
+	require.NoError(t, f.AppendToLog(snapshot(repositories.Metrics{ID: "PollCount", MType: "counter", Delta: &first})))
+	require.NoError(t, f.AppendToLog(snapshot(repositories.Metrics{ID: "Alloc", MType: "gauge", Value: &gaugeValue})))
+	require.NoError(t, f.AppendToLog(snapshot(repositories.Metrics{ID: "PollCount", MType: "counter", Delta: &second})))
+
+	// Simulate a crash mid-append.
+	_, err = f.Log.Write([]byte(`[{"id":"PollCount","type":"coun`))
+	require.NoError(t, err)
+
+	m, err := f.LoadLog()
+	require.NoError(t, err)
+	require.Len(t, m, 3)
+	assert.Equal(t, second, *m[2].Delta)
+
+	require.NoError(t, f.SaveAllToDisk(snapshot(m...)))
+
+	m, err = f.LoadLog()
+	require.NoError(t, err)
+	assert.Empty(t, m)
+
+	m, err = f.LoadFromDisk()
+	require.NoError(t, err)
+	assert.Len(t, m, 3)
+}
+
+func TestWriteAheadLogTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, os.WriteFile(path+".wal", []byte(`[{"id":"PollCount","type":"counter","delta":5}]
+[{"id":"PollCount","type":"coun`), 0644))
+
+	// The log isn't replayed, yet the next record must not be glued to the torn one.
+	f, err := NewRepository(path, 0, 1, FormatJSON)
+	require.NoError(t, err)
+	defer f.Close()
+
+	v := float64(3)
+	require.NoError(t, f.AppendToLog(snapshot(repositories.Metrics{ID: "Alloc", MType: "gauge", Value: &v})))
+
+	m, err := f.LoadLog()
+	require.NoError(t, err)
+	require.Len(t, m, 2)
+	assert.Equal(t, "PollCount", m[0].ID)
+	assert.Equal(t, "Alloc", m[1].ID)
+}
+
+// snapshot hands m to SaveAllToDisk or AppendToLog.
+func snapshot(m ...repositories.Metrics) func() ([]repositories.Metrics, error) {
+	return func() ([]repositories.Metrics, error) {
+		return m, nil
+	}
+}
+
+func TestBinaryFormatMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	value, delta := float64(1.5), int64(42)
+	metrics := []repositories.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &value},
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+	}
+
+	jsonStore, err := NewRepository(path, time.Second, 1, FormatJSON)
+	require.NoError(t, err)
+	require.NoError(t, jsonStore.SaveAllToDisk(snapshot(metrics...)))
+
+	binaryStore, err := NewRepository(path, time.Second, 1, FormatBinary)
+	require.NoError(t, err)
+
+	m, err := binaryStore.LoadFromDisk()
+	require.NoError(t, err)
+	assert.Equal(t, metrics, m)
+
+	require.NoError(t, binaryStore.SaveAllToDisk(snapshot(m...)))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.True(t, isBinarySnapshot(b))
+
+	m, err = binaryStore.LoadFromDisk()
+	require.NoError(t, err)
+	assert.Equal(t, metrics, m)
+
+	// Flip a byte of the payload: the checksum must reject it and the JSON snapshot
+	// kept as Path.1 is used instead.
+	b[len(b)-6] ^= 0xff
+	require.NoError(t, os.WriteFile(path, b, 0644))
+
+	_, err = decodeBinary(b)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+
+	m, err = binaryStore.LoadFromDisk()
+	require.NoError(t, err)
+	assert.Equal(t, metrics, m)
+}
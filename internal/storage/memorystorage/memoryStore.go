@@ -1,7 +1,7 @@
 package memorystorage
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"strconv"
 	"sync"
@@ -24,26 +24,16 @@ type MemStorage struct {
 	CounterMetricsMutex *sync.RWMutex
 }
 
-var metricsList = []string{"Alloc", "BuckHashSys", "Frees", "GCCPUFraction", "GCSys", "HeapAlloc", "HeapIdle", "HeapInuse", "HeapObjects", "HeapReleased", "HeapSys", "LastGC", "Lookups", "MCacheInuse", "MCacheSys", "MSpanInuse", "MSpanSys", "Mallocs", "NextGC", "NumForcedGC", "NumGC", "OtherSys", "PauseTotalNs", "StackInuse", "StackSys", "Sys", "TotalAlloc", "RandomValue"}
-
 func NewRepository() *MemStorage {
-	gaugeDefault := make(GaugeMetrics)
-	for _, v := range metricsList {
-		gaugeDefault[v] = gauge(0)
-	}
-
-	counterDefault := make(CounterMetrics)
-	counterDefault["PollCount"] = 0
-
 	return &MemStorage{
-		GaugeMetrics:        gaugeDefault,
+		GaugeMetrics:        make(GaugeMetrics),
 		GaugeMetricsMutex:   &sync.RWMutex{},
-		CounterMetrics:      counterDefault,
+		CounterMetrics:      make(CounterMetrics),
 		CounterMetricsMutex: &sync.RWMutex{},
 	}
 }
 
-func (m *MemStorage) UpdateGaugeMetrics(name, value string) error {
+func (m *MemStorage) UpdateGaugeMetrics(ctx context.Context, name, value string) error {
 	g, err := strconv.ParseFloat(value, 64)
 	if err != nil {
 		return fmt.Errorf("unable to get value to gauge. value: %v, error: %v", value, err)
@@ -57,7 +47,7 @@ func (m *MemStorage) UpdateGaugeMetrics(name, value string) error {
 	return nil
 }
 
-func (m *MemStorage) UpdateCounterMetrics(name, value string) (int64, error) {
+func (m *MemStorage) UpdateCounterMetrics(ctx context.Context, name, value string) (int64, error) {
 	g, err := strconv.Atoi(value)
 	if err != nil {
 		return 0, fmt.Errorf("unable to parse value to counter. value: %v, error: %v", value, err)
@@ -76,16 +66,30 @@ func (m *MemStorage) UpdateCounterMetrics(name, value string) (int64, error) {
 
 	return int64(v), nil
 }
-func (m *MemStorage) UpdateBatchMetrics(metrics []repositories.Metrics) error {
+func (m *MemStorage) UpdateBatchMetrics(ctx context.Context, metrics []repositories.Metrics) error {
+	for _, v := range metrics {
+		switch v.MType {
+		case "counter":
+			if v.Delta == nil {
+				return fmt.Errorf("counter %s has no delta", v.ID)
+			}
+		case "gauge":
+			if v.Value == nil {
+				return fmt.Errorf("gauge %s has no value", v.ID)
+			}
+		}
+	}
+
+	m.CounterMetricsMutex.Lock()
+	defer m.CounterMetricsMutex.Unlock()
+	m.GaugeMetricsMutex.Lock()
+	defer m.GaugeMetricsMutex.Unlock()
+
 	for _, v := range metrics {
 		switch v.MType {
 		case "counter":
-			m.CounterMetricsMutex.Lock()
-			defer m.CounterMetricsMutex.Unlock()
 			m.CounterMetrics[v.ID] += counter(*v.Delta)
 		case "gauge":
-			m.GaugeMetricsMutex.Lock()
-			defer m.GaugeMetricsMutex.Unlock()
 			m.GaugeMetrics[v.ID] = gauge(*v.Value)
 		}
 
@@ -93,29 +97,29 @@ func (m *MemStorage) UpdateBatchMetrics(metrics []repositories.Metrics) error {
 	return nil
 }
 
-func (m *MemStorage) GetGaugeMetrics(name string) (string, error) {
+func (m *MemStorage) GetGaugeMetrics(ctx context.Context, name string) (string, error) {
 	m.GaugeMetricsMutex.RLock()
 	defer m.GaugeMetricsMutex.RUnlock()
 
 	v, ok := m.GaugeMetrics[name]
 	if !ok {
-		return "", errors.New("Gauge metric not found. \n MetricID:" + name)
+		return "", fmt.Errorf("%w: gauge %s", repositories.ErrMetricNotFound, name)
 	}
 	return fmt.Sprintf("%v", v), nil
 }
 
-func (m *MemStorage) GetCounterMetrics(name string) (string, error) {
+func (m *MemStorage) GetCounterMetrics(ctx context.Context, name string) (string, error) {
 	m.CounterMetricsMutex.RLock()
 	defer m.CounterMetricsMutex.RUnlock()
 
 	v, ok := m.CounterMetrics[name]
 	if !ok {
-		return "", errors.New("Counter metric not found. \n MetricID:" + name)
+		return "", fmt.Errorf("%w: counter %s", repositories.ErrMetricNotFound, name)
 	}
 	return fmt.Sprintf("%v", v), nil
 }
 
-func (m *MemStorage) GetAllGaugeMetrics() []repositories.Metrics {
+func (m *MemStorage) GetAllGaugeMetrics(ctx context.Context) ([]repositories.Metrics, error) {
 	m.GaugeMetricsMutex.RLock()
 	defer m.GaugeMetricsMutex.RUnlock()
 
@@ -126,10 +130,10 @@ func (m *MemStorage) GetAllGaugeMetrics() []repositories.Metrics {
 		res = append(res, repositories.Metrics{ID: k, MType: "gauge", Value: &x})
 	}
 
-	return res
+	return res, nil
 }
 
-func (m *MemStorage) GetAllCounterMetrics() []repositories.Metrics {
+func (m *MemStorage) GetAllCounterMetrics(ctx context.Context) ([]repositories.Metrics, error) {
 	m.CounterMetricsMutex.RLock()
 	defer m.CounterMetricsMutex.RUnlock()
 
@@ -140,8 +144,8 @@ func (m *MemStorage) GetAllCounterMetrics() []repositories.Metrics {
 		res = append(res, repositories.Metrics{ID: k, MType: "counter", Delta: &x})
 	}
 
-	return res
+	return res, nil
 }
-func (m *MemStorage) Ping() error {
+func (m *MemStorage) Ping(ctx context.Context) error {
 	return nil
 }
@@ -0,0 +1,132 @@
+package memorystorage
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+	"github.com/fkocharli/metricity/internal/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) repositories.Storage {
+		return NewRepository()
+	})
+}
+
+func TestShardedConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) repositories.Storage {
+		return NewShardedRepository(0)
+	})
+}
+
+// BenchmarkUpdateBatchMetrics simulates many agents reporting concurrently: every
+// batch carries the runtime gauges all agents share, PollCount and a few gauges
+// unique to the agent.
+//
+//	go test -bench UpdateBatchMetrics -cpu 1,4,16 ./internal/storage/memorystorage/
+func BenchmarkUpdateBatchMetrics(b *testing.B) {
+	backends := []struct {
+		name string
+		repo repositories.Storage
+	}{
+		{"mutex", NewRepository()},
+		{"sharded", NewShardedRepository(0)},
+	}
+
+	for _, bb := range backends {
+		repo := bb.repo
+		b.Run(bb.name, func(b *testing.B) {
+			var agents int64
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				batch := agentBatch(atomic.AddInt64(&agents, 1))
+				ctx := context.Background()
+				for pb.Next() {
+					if err := repo.UpdateBatchMetrics(ctx, batch); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkUpdateBatchMetricsWhileReading writes batches while the whole store is read
+// over and over, as snapshots and the dashboard do. A reader of the mutex store holds
+// off every writer until it is done; writers to existing metrics of the sharded store
+// only share a shard's read lock with it and keep going.
+// Run it with go test -bench WhileReading -cpu 4.
+func BenchmarkUpdateBatchMetricsWhileReading(b *testing.B) {
+	for _, bb := range []struct {
+		name string
+		repo repositories.Storage
+	}{
+		{"mutex", NewRepository()},
+		{"sharded", NewShardedRepository(0)},
+	} {
+		repo := bb.repo
+		b.Run(bb.name, func(b *testing.B) {
+			ctx := context.Background()
+			filler := make([]repositories.Metrics, 0, 50000)
+			for i := 0; i < cap(filler); i++ {
+				v := float64(i)
+				filler = append(filler, repositories.Metrics{ID: fmt.Sprintf("Filler%d", i), MType: "gauge", Value: &v})
+			}
+			if err := repo.UpdateBatchMetrics(ctx, filler); err != nil {
+				b.Fatal(err)
+			}
+			batch := agentBatch(0)
+			if err := repo.UpdateBatchMetrics(ctx, batch); err != nil {
+				b.Fatal(err)
+			}
+
+			done := make(chan struct{})
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					if _, err := repo.GetAllGaugeMetrics(ctx); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			}()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := repo.UpdateBatchMetrics(ctx, batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+var runtimeMetrics = []string{"Alloc", "BuckHashSys", "Frees", "GCCPUFraction", "GCSys", "HeapAlloc", "HeapIdle", "HeapInuse", "HeapObjects", "HeapReleased", "HeapSys", "LastGC", "Lookups", "MCacheInuse", "MCacheSys", "MSpanInuse", "MSpanSys", "Mallocs", "NextGC", "NumForcedGC", "NumGC", "OtherSys", "PauseTotalNs", "StackInuse", "StackSys", "Sys", "TotalAlloc", "RandomValue"}
+
+func agentBatch(agent int64) []repositories.Metrics {
+	batch := make([]repositories.Metrics, 0, len(runtimeMetrics)+5)
+	for i, id := range runtimeMetrics {
+		v := float64(i)
+		batch = append(batch, repositories.Metrics{ID: id, MType: "gauge", Value: &v})
+	}
+	for i := 0; i < 4; i++ {
+		v := float64(i)
+		batch = append(batch, repositories.Metrics{ID: fmt.Sprintf("Agent%dGauge%d", agent, i), MType: "gauge", Value: &v})
+	}
+	delta := int64(1)
+	return append(batch, repositories.Metrics{ID: "PollCount", MType: "counter", Delta: &delta})
+}
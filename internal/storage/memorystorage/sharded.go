@@ -0,0 +1,281 @@
+package memorystorage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+)
+
+// DefaultShards is the number of shards used by NewShardedRepository when
+// it is given a non-positive count.
+const DefaultShards = 64
+
+// ShardedStorage spreads metrics over shards by the hash of their ID. Values are
+// updated with atomic operations under the shard's read lock, so writers to
+// existing metrics never block each other; the write lock is only taken to add
+// a new metric to its shard.
+type ShardedStorage struct {
+	shards []*shard
+	mask   uint32
+}
+
+type shard struct {
+	mutex    *sync.RWMutex
+	gauges   map[string]*uint64
+	counters map[string]*int64
+}
+
+// NewShardedRepository creates a store with the given number of shards, rounded
+// up to a power of two.
+func NewShardedRepository(shards int) *ShardedStorage {
+	if shards <= 0 {
+		shards = DefaultShards
+	}
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+
+	s := &ShardedStorage{
+		shards: make([]*shard, n),
+		mask:   uint32(n - 1),
+	}
+	for i := range s.shards {
+		s.shards[i] = &shard{
+			mutex:    &sync.RWMutex{},
+			gauges:   make(map[string]*uint64),
+			counters: make(map[string]*int64),
+		}
+	}
+
+	return s
+}
+
+// shardFor picks the shard of the metric ID.
+func (s *ShardedStorage) shardFor(name string) *shard {
+	return s.shards[s.shardIndex(name)]
+}
+
+// shardIndex is the 32-bit FNV-1a hash of the metric ID masked to the number of shards.
+func (s *ShardedStorage) shardIndex(name string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return h & s.mask
+}
+
+func (s *ShardedStorage) setGauge(name string, v float64) {
+	sh := s.shardFor(name)
+	bits := math.Float64bits(v)
+
+	sh.mutex.RLock()
+	p, ok := sh.gauges[name]
+	if ok {
+		atomic.StoreUint64(p, bits)
+	}
+	sh.mutex.RUnlock()
+	if ok {
+		return
+	}
+
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	if p, ok := sh.gauges[name]; ok {
+		atomic.StoreUint64(p, bits)
+		return
+	}
+	p = new(uint64)
+	*p = bits
+	sh.gauges[name] = p
+}
+
+func (s *ShardedStorage) addCounter(name string, delta int64) int64 {
+	sh := s.shardFor(name)
+
+	sh.mutex.RLock()
+	p, ok := sh.counters[name]
+	var v int64
+	if ok {
+		v = atomic.AddInt64(p, delta)
+	}
+	sh.mutex.RUnlock()
+	if ok {
+		return v
+	}
+
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	if p, ok := sh.counters[name]; ok {
+		return atomic.AddInt64(p, delta)
+	}
+	p = new(int64)
+	*p = delta
+	sh.counters[name] = p
+	return delta
+}
+
+func (s *ShardedStorage) UpdateGaugeMetrics(ctx context.Context, name, value string) error {
+	g, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("unable to get value to gauge. value: %v, error: %v", value, err)
+	}
+
+	s.setGauge(name, g)
+	return nil
+}
+
+func (s *ShardedStorage) UpdateCounterMetrics(ctx context.Context, name, value string) (int64, error) {
+	g, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse value to counter. value: %v, error: %v", value, err)
+	}
+
+	return s.addCounter(name, g), nil
+}
+
+// UpdateBatchMetrics checks the whole batch before applying it, so an invalid metric
+// rejects all of them. Readers may observe a batch partially applied.
+func (s *ShardedStorage) UpdateBatchMetrics(ctx context.Context, metrics []repositories.Metrics) error {
+	for _, v := range metrics {
+		switch v.MType {
+		case "counter":
+			if v.Delta == nil {
+				return fmt.Errorf("counter %s has no delta", v.ID)
+			}
+		case "gauge":
+			if v.Value == nil {
+				return fmt.Errorf("gauge %s has no value", v.ID)
+			}
+		}
+	}
+
+	// Group the batch by shard, so each shard is locked once per batch.
+	groups := make([][]repositories.Metrics, len(s.shards))
+	for _, v := range metrics {
+		k := s.shardIndex(v.ID)
+		groups[k] = append(groups[k], v)
+	}
+	for k, group := range groups {
+		if len(group) > 0 {
+			s.shards[k].apply(group)
+		}
+	}
+	return nil
+}
+
+// apply updates the metrics of this shard in order. Metrics that already exist are
+// updated under the read lock; from the first new one on, the rest are applied under
+// the write lock.
+func (sh *shard) apply(metrics []repositories.Metrics) {
+	i := 0
+	sh.mutex.RLock()
+	for i < len(metrics) && sh.update(metrics[i]) {
+		i++
+	}
+	sh.mutex.RUnlock()
+	if i == len(metrics) {
+		return
+	}
+
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	for _, v := range metrics[i:] {
+		switch v.MType {
+		case "counter":
+			if _, ok := sh.counters[v.ID]; !ok {
+				sh.counters[v.ID] = new(int64)
+			}
+		case "gauge":
+			if _, ok := sh.gauges[v.ID]; !ok {
+				sh.gauges[v.ID] = new(uint64)
+			}
+		}
+		sh.update(v)
+	}
+}
+
+// update applies the metric if it exists in the shard, which must be locked.
+func (sh *shard) update(v repositories.Metrics) bool {
+	switch v.MType {
+	case "counter":
+		p, ok := sh.counters[v.ID]
+		if ok {
+			atomic.AddInt64(p, *v.Delta)
+		}
+		return ok
+	case "gauge":
+		p, ok := sh.gauges[v.ID]
+		if ok {
+			atomic.StoreUint64(p, math.Float64bits(*v.Value))
+		}
+		return ok
+	}
+	return true
+}
+
+func (s *ShardedStorage) GetGaugeMetrics(ctx context.Context, name string) (string, error) {
+	sh := s.shardFor(name)
+
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+
+	p, ok := sh.gauges[name]
+	if !ok {
+		return "", fmt.Errorf("%w: gauge %s", repositories.ErrMetricNotFound, name)
+	}
+	return fmt.Sprintf("%v", math.Float64frombits(atomic.LoadUint64(p))), nil
+}
+
+func (s *ShardedStorage) GetCounterMetrics(ctx context.Context, name string) (string, error) {
+	sh := s.shardFor(name)
+
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+
+	p, ok := sh.counters[name]
+	if !ok {
+		return "", fmt.Errorf("%w: counter %s", repositories.ErrMetricNotFound, name)
+	}
+	return fmt.Sprintf("%v", atomic.LoadInt64(p)), nil
+}
+
+func (s *ShardedStorage) GetAllGaugeMetrics(ctx context.Context) ([]repositories.Metrics, error) {
+	res := []repositories.Metrics{}
+
+	for _, sh := range s.shards {
+		sh.mutex.RLock()
+		for k, p := range sh.gauges {
+			x := math.Float64frombits(atomic.LoadUint64(p))
+			res = append(res, repositories.Metrics{ID: k, MType: "gauge", Value: &x})
+		}
+		sh.mutex.RUnlock()
+	}
+
+	return res, nil
+}
+
+func (s *ShardedStorage) GetAllCounterMetrics(ctx context.Context) ([]repositories.Metrics, error) {
+	res := []repositories.Metrics{}
+
+	for _, sh := range s.shards {
+		sh.mutex.RLock()
+		for k, p := range sh.counters {
+			x := atomic.LoadInt64(p)
+			res = append(res, repositories.Metrics{ID: k, MType: "counter", Delta: &x})
+		}
+		sh.mutex.RUnlock()
+	}
+
+	return res, nil
+}
+
+func (s *ShardedStorage) Ping(ctx context.Context) error {
+	return nil
+}
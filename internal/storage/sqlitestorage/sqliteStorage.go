@@ -0,0 +1,79 @@
+package sqlitestorage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/storage/sqlstorage"
+
+	_ "modernc.org/sqlite"
+)
+
+// Scheme selects SQLite in DATABASE_DSN, e.g. sqlite:///var/lib/metricity/metrics.db.
+const Scheme = "sqlite://"
+
+const schema = `
+CREATE TABLE IF NOT EXISTS metrics (
+	metricID TEXT NOT NULL,
+	type     TEXT NOT NULL,
+	counter  INTEGER,
+	gauge    REAL,
+	PRIMARY KEY (metricID, type)
+)`
+
+// SQLiteRepo keeps metrics in a local SQLite database file. Every write is committed
+// with a synchronous WAL, so small deployments get durability without a DB service.
+type SQLiteRepo struct {
+	*sqlstorage.Repo
+}
+
+// ParseDSN returns the database file path if dsn uses the sqlite:// scheme.
+func ParseDSN(dsn string) (string, bool) {
+	if !strings.HasPrefix(dsn, Scheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(dsn, Scheme), true
+}
+
+// Open opens the database file at path. SQLite allows a single writer, so the pool
+// is limited to one connection and writers queue in Go instead of failing with SQLITE_BUSY.
+func Open(path string) (*sql.DB, error) {
+	if path == "" {
+		return nil, errors.New("sqlite database path is empty")
+	}
+
+	q := url.Values{}
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "synchronous(FULL)")
+	q.Add("_pragma", "busy_timeout(5000)")
+
+	// The path is escaped, so a ? or # in it isn't taken for the start of the query.
+	db, err := sql.Open("sqlite", "file:"+url.PathEscape(path)+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	return db, nil
+}
+
+func NewRepository(db *sql.DB, queryTimeout time.Duration) (*SQLiteRepo, error) {
+	s := &SQLiteRepo{
+		Repo: sqlstorage.New(db, queryTimeout),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := s.DB.ExecContext(ctx, schema); err != nil {
+		log.Printf("Error %s when creating table", err)
+		return nil, err
+	}
+
+	return s, nil
+}
@@ -0,0 +1,137 @@
+package sqlitestorage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+	"github.com/fkocharli/metricity/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRepo(t *testing.T, path string) *SQLiteRepo {
+	t.Helper()
+
+	db, err := Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	s, err := NewRepository(db, 5*time.Second)
+	require.NoError(t, err)
+	return s
+}
+
+func TestParseDSN(t *testing.T) {
+	path, ok := ParseDSN("sqlite:///var/lib/metricity/metrics.db")
+	assert.True(t, ok)
+	assert.Equal(t, "/var/lib/metricity/metrics.db", path)
+
+	path, ok = ParseDSN("sqlite://metrics.db")
+	assert.True(t, ok)
+	assert.Equal(t, "metrics.db", path)
+
+	_, ok = ParseDSN("postgres://localhost:5432/metrics")
+	assert.False(t, ok)
+}
+
+func TestSQLiteRepo(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	s := testRepo(t, path)
+
+	require.NoError(t, s.UpdateGaugeMetrics(ctx, "Alloc", "1.5"))
+	v, err := s.UpdateCounterMetrics(ctx, "PollCount", "3")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), v)
+
+	value, delta := float64(2.5), int64(4)
+	require.NoError(t, s.UpdateBatchMetrics(ctx, []repositories.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &value},
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+	}))
+
+	// A broken batch is rolled back as a whole.
+	assert.Error(t, s.UpdateBatchMetrics(ctx, []repositories.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "Frees", MType: "gauge"},
+	}))
+
+	_, err = s.GetGaugeMetrics(ctx, "Frees")
+	assert.ErrorIs(t, err, repositories.ErrMetricNotFound)
+
+	// The data survives reopening the file.
+	s = testRepo(t, path)
+
+	g, err := s.GetGaugeMetrics(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, "2.5", g)
+
+	c, err := s.GetCounterMetrics(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, "7", c)
+
+	_, err = s.GetCounterMetrics(ctx, "Alloc")
+	assert.ErrorIs(t, err, repositories.ErrMetricNotFound)
+
+	gauges, err := s.GetAllGaugeMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []repositories.Metrics{{ID: "Alloc", MType: "gauge", Value: &value}}, gauges)
+
+	counters, err := s.GetAllCounterMetrics(ctx)
+	require.NoError(t, err)
+	require.Len(t, counters, 1)
+	assert.Equal(t, int64(7), *counters[0].Delta)
+
+	assert.NoError(t, s.Ping(ctx))
+}
+
+// Replicas sharing the file through separate connections must not lose increments.
+func TestOpenEscapesPath(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics?mode=ro#50%.db")
+	s := testRepo(t, path)
+
+	require.NoError(t, s.UpdateGaugeMetrics(ctx, "Alloc", "1.5"))
+	_, err := os.Stat(path)
+	assert.NoError(t, err)
+}
+
+func TestNoLostCounterUpdatesAcrossReplicas(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	storagetest.RunReplicas(t, func(t *testing.T) repositories.Storage {
+		return testRepo(t, path)
+	})
+}
+
+func TestSeedMetrics(t *testing.T) {
+	ctx := context.Background()
+	s := testRepo(t, filepath.Join(t.TempDir(), "metrics.db"))
+
+	_, err := s.UpdateCounterMetrics(ctx, "PollCount", "10")
+	require.NoError(t, err)
+
+	snapshotCount, snapshotAlloc := int64(3), float64(1.5)
+	require.NoError(t, s.SeedMetrics(ctx, []repositories.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &snapshotCount},
+		{ID: "Alloc", MType: "gauge", Value: &snapshotAlloc},
+	}))
+
+	// Stored metrics are kept, missing ones are added.
+	c, err := s.GetCounterMetrics(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, "10", c)
+
+	g, err := s.GetGaugeMetrics(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, "1.5", g)
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) repositories.Storage {
+		return testRepo(t, filepath.Join(t.TempDir(), "metrics.db"))
+	})
+}
@@ -0,0 +1,291 @@
+// Package sqlstorage implements repositories.Storage on top of database/sql for the
+// backends sharing the metrics table, Postgres (dbstorage) and SQLite (sqlitestorage).
+// Statements use $N placeholders, which both databases accept, and upserts, so every
+// write is a single statement and replicas sharing a database don't lose updates.
+package sqlstorage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+)
+
+const (
+	upsertGauge = `
+	INSERT INTO metrics (metricID, type, gauge)
+	VALUES ($1, 'gauge', $2)
+	ON CONFLICT (metricID, type) DO UPDATE
+	SET gauge = EXCLUDED.gauge
+	`
+	upsertCounter = `
+	INSERT INTO metrics (metricID, type, counter)
+	VALUES ($1, 'counter', $2)
+	ON CONFLICT (metricID, type) DO UPDATE
+	SET counter = COALESCE(metrics.counter, 0) + EXCLUDED.counter
+	RETURNING counter
+	`
+	seedGauge = `
+	INSERT INTO metrics (metricID, type, gauge)
+	VALUES ($1, 'gauge', $2)
+	ON CONFLICT (metricID, type) DO NOTHING
+	`
+	seedCounter = `
+	INSERT INTO metrics (metricID, type, counter)
+	VALUES ($1, 'counter', $2)
+	ON CONFLICT (metricID, type) DO NOTHING
+	`
+	selectGauge    = "SELECT gauge FROM metrics WHERE metricID = $1 AND type = 'gauge' AND gauge IS NOT NULL"
+	selectCounter  = "SELECT counter FROM metrics WHERE metricID = $1 AND type = 'counter' AND counter IS NOT NULL"
+	selectGauges   = "SELECT metricID, type, gauge FROM metrics WHERE type = 'gauge' AND gauge IS NOT NULL"
+	selectCounters = "SELECT metricID, type, counter FROM metrics WHERE type = 'counter' AND counter IS NOT NULL"
+)
+
+// Repo keeps metrics in the metrics table of DB, which the backend creates.
+// Each query is bounded by QueryTimeout on top of the caller's context.
+type Repo struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+}
+
+func New(db *sql.DB, queryTimeout time.Duration) *Repo {
+	return &Repo{
+		DB:           db,
+		QueryTimeout: queryTimeout,
+	}
+}
+
+func (r *Repo) Ping(ctx context.Context) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	return queryError(ctx, r.DB.PingContext(ctx))
+}
+
+func (r *Repo) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, r.QueryTimeout)
+}
+
+// queryError makes sure a failure caused by an expired or canceled context
+// wraps the context error, whatever the driver returned.
+func queryError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%w: %v", ctxErr, err)
+	}
+	return err
+}
+
+func (r *Repo) UpdateGaugeMetrics(ctx context.Context, name, value string) error {
+	g, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("unable to parse value to gauge. value: %v, error: %v", value, err)
+	}
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := r.DB.ExecContext(ctx, upsertGauge, name, g); err != nil {
+		log.Printf("Error %s when upserting gauge", err)
+		return queryError(ctx, err)
+	}
+
+	return nil
+}
+
+func (r *Repo) UpdateCounterMetrics(ctx context.Context, name, value string) (int64, error) {
+	g, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse value to counter. value: %v, error: %v", value, err)
+	}
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var v int64
+	if err := r.DB.QueryRowContext(ctx, upsertCounter, name, g).Scan(&v); err != nil {
+		log.Printf("Error %s when upserting counter", err)
+		return 0, queryError(ctx, err)
+	}
+
+	return v, nil
+}
+
+// UpdateBatchMetrics applies the whole batch in one transaction: either all
+// metrics are written or none of them.
+func (r *Repo) UpdateBatchMetrics(ctx context.Context, metrics []repositories.Metrics) error {
+	// Rows are locked in ID order, so concurrent batches touching the same
+	// metrics can't deadlock each other.
+	metrics = append([]repositories.Metrics(nil), metrics...)
+	sort.SliceStable(metrics, func(i, j int) bool { return metrics[i].ID < metrics[j].ID })
+
+	return r.inTx(ctx, "batch update", func(ctx context.Context, tx *sql.Tx) error {
+		return updateBatch(ctx, tx, metrics)
+	})
+}
+
+func updateBatch(ctx context.Context, tx *sql.Tx, metrics []repositories.Metrics) error {
+	gaugeStmt, err := tx.PrepareContext(ctx, upsertGauge)
+	if err != nil {
+		log.Printf("Error on preparing transaction for Batch update gauge. Error: %v", err)
+		return err
+	}
+	defer gaugeStmt.Close()
+
+	counterStmt, err := tx.PrepareContext(ctx, upsertCounter)
+	if err != nil {
+		log.Printf("Error on preparing transaction for Batch update counter. Error: %v", err)
+		return err
+	}
+	defer counterStmt.Close()
+
+	for _, v := range metrics {
+		switch v.MType {
+		case "gauge":
+			if v.Value == nil {
+				return fmt.Errorf("gauge %s has no value", v.ID)
+			}
+			if _, err := gaugeStmt.ExecContext(ctx, v.ID, *v.Value); err != nil {
+				log.Printf("Error on Batch update gauge. Error: %v", err)
+				return err
+			}
+		case "counter":
+			if v.Delta == nil {
+				return fmt.Errorf("counter %s has no delta", v.ID)
+			}
+			var total int64
+			if err := counterStmt.QueryRowContext(ctx, v.ID, *v.Delta).Scan(&total); err != nil {
+				log.Printf("Error on Batch update counter. Error: %v", err)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// SeedMetrics inserts the metrics the database doesn't have yet and leaves the stored
+// ones untouched, so seeding from a snapshot never rewinds what replicas have written.
+func (r *Repo) SeedMetrics(ctx context.Context, metrics []repositories.Metrics) error {
+	return r.inTx(ctx, "seeding", func(ctx context.Context, tx *sql.Tx) error {
+		for _, v := range metrics {
+			var err error
+			switch {
+			case v.MType == "gauge" && v.Value != nil:
+				_, err = tx.ExecContext(ctx, seedGauge, v.ID, *v.Value)
+			case v.MType == "counter" && v.Delta != nil:
+				_, err = tx.ExecContext(ctx, seedCounter, v.ID, *v.Delta)
+			}
+			if err != nil {
+				log.Printf("Error on seeding Metric %v. Error: %v", v, err)
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// inTx runs fn in a transaction, committing it when fn succeeds and rolling it back otherwise.
+func (r *Repo) inTx(ctx context.Context, op string, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return queryError(ctx, err)
+	}
+
+	if err := fn(ctx, tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Printf("Unable to rollback %s. Error: %v", op, rbErr)
+		}
+		return queryError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Unable to commit %s. Error: %v", op, err)
+		return queryError(ctx, err)
+	}
+
+	return nil
+}
+
+func (r *Repo) GetGaugeMetrics(ctx context.Context, name string) (string, error) {
+	var val float64
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	err := r.DB.QueryRowContext(ctx, selectGauge, name).Scan(&val)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%w: gauge %s", repositories.ErrMetricNotFound, name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to get stored gauge value: %w", queryError(ctx, err))
+	}
+	return fmt.Sprintf("%v", val), nil
+}
+
+func (r *Repo) GetCounterMetrics(ctx context.Context, name string) (string, error) {
+	var val int64
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	err := r.DB.QueryRowContext(ctx, selectCounter, name).Scan(&val)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%w: counter %s", repositories.ErrMetricNotFound, name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to get stored counter value: %w", queryError(ctx, err))
+	}
+
+	return fmt.Sprintf("%v", val), nil
+}
+
+func (r *Repo) GetAllGaugeMetrics(ctx context.Context) ([]repositories.Metrics, error) {
+	return r.getAll(ctx, selectGauges, func(rows *sql.Rows, m *repositories.Metrics) error {
+		return rows.Scan(&m.ID, &m.MType, &m.Value)
+	})
+}
+
+func (r *Repo) GetAllCounterMetrics(ctx context.Context) ([]repositories.Metrics, error) {
+	return r.getAll(ctx, selectCounters, func(rows *sql.Rows, m *repositories.Metrics) error {
+		return rows.Scan(&m.ID, &m.MType, &m.Delta)
+	})
+}
+
+func (r *Repo) getAll(ctx context.Context, query string, scan func(rows *sql.Rows, m *repositories.Metrics) error) ([]repositories.Metrics, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	res := []repositories.Metrics{}
+	for rows.Next() {
+		var m repositories.Metrics
+		if err := scan(rows, &m); err != nil {
+			return nil, queryError(ctx, err)
+		}
+		res = append(res, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+	return res, nil
+}
@@ -0,0 +1,273 @@
+// Package storagetest is the conformance suite for repositories.Storage implementations.
+// Every backend runs it from its own tests, so they all agree on the contract:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) repositories.Storage { return NewRepository() })
+//	}
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+	"github.com/fkocharli/metricity/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run executes every contract test against a fresh storage returned by newStorage.
+// Backends may share state between calls (e.g. one Postgres database), so tests
+// only rely on metrics they created themselves.
+func Run(t *testing.T, newStorage func(t *testing.T) repositories.Storage) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s repositories.Storage, prefix string)
+	}{
+		{"Gauge", testGauge},
+		{"Counter", testCounter},
+		{"InvalidValues", testInvalidValues},
+		{"NotFound", testNotFound},
+		{"TypesAreSeparate", testTypesAreSeparate},
+		{"Batch", testBatch},
+		{"BatchIsAtomic", testBatchIsAtomic},
+		{"List", testList},
+		{"ConcurrentUpdates", testConcurrentUpdates},
+		{"Ping", testPing},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStorage(t), fmt.Sprintf("%s%d", tt.name, time.Now().UnixNano()))
+		})
+	}
+}
+
+// RunReplicas checks that counter increments made concurrently through several
+// storages sharing one database, as server replicas do, are never lost. newReplica
+// must open a new connection to the same database on every call.
+func RunReplicas(t *testing.T, newReplica func(t *testing.T) repositories.Storage) {
+	ctx := context.Background()
+	replicas := []repositories.Storage{newReplica(t), newReplica(t)}
+
+	name := fmt.Sprintf("ConcurrentCounter%d", time.Now().UnixNano())
+	const (
+		workers    = 8
+		increments = 50
+	)
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(s repositories.Storage) {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				if i%2 == 0 {
+					_, err := s.UpdateCounterMetrics(ctx, name, "1")
+					assert.NoError(t, err)
+					continue
+				}
+				assert.NoError(t, s.UpdateBatchMetrics(ctx, []repositories.Metrics{testutil.Counter(name, 1)}))
+			}
+		}(replicas[w%len(replicas)])
+	}
+	wg.Wait()
+
+	for _, s := range replicas {
+		v, err := s.GetCounterMetrics(ctx, name)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprint(workers*increments), v)
+	}
+}
+
+func testGauge(t *testing.T, s repositories.Storage, prefix string) {
+	ctx := context.Background()
+	name := prefix + "Alloc"
+
+	require.NoError(t, s.UpdateGaugeMetrics(ctx, name, "1.5"))
+	require.NoError(t, s.UpdateGaugeMetrics(ctx, name, "-0.25"))
+
+	v, err := s.GetGaugeMetrics(ctx, name)
+	require.NoError(t, err)
+	assert.Equal(t, "-0.25", v)
+}
+
+func testCounter(t *testing.T, s repositories.Storage, prefix string) {
+	ctx := context.Background()
+	name := prefix + "PollCount"
+
+	v, err := s.UpdateCounterMetrics(ctx, name, "5")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), v)
+
+	v, err = s.UpdateCounterMetrics(ctx, name, "-2")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), v)
+
+	got, err := s.GetCounterMetrics(ctx, name)
+	require.NoError(t, err)
+	assert.Equal(t, "3", got)
+}
+
+func testInvalidValues(t *testing.T, s repositories.Storage, prefix string) {
+	ctx := context.Background()
+
+	assert.Error(t, s.UpdateGaugeMetrics(ctx, prefix+"Alloc", "none"))
+	_, err := s.UpdateCounterMetrics(ctx, prefix+"PollCount", "1.5")
+	assert.Error(t, err)
+
+	_, err = s.GetGaugeMetrics(ctx, prefix+"Alloc")
+	assert.ErrorIs(t, err, repositories.ErrMetricNotFound)
+	_, err = s.GetCounterMetrics(ctx, prefix+"PollCount")
+	assert.ErrorIs(t, err, repositories.ErrMetricNotFound)
+}
+
+func testNotFound(t *testing.T, s repositories.Storage, prefix string) {
+	ctx := context.Background()
+
+	_, err := s.GetGaugeMetrics(ctx, prefix+"Missing")
+	assert.ErrorIs(t, err, repositories.ErrMetricNotFound)
+
+	_, err = s.GetCounterMetrics(ctx, prefix+"Missing")
+	assert.ErrorIs(t, err, repositories.ErrMetricNotFound)
+}
+
+func testTypesAreSeparate(t *testing.T, s repositories.Storage, prefix string) {
+	ctx := context.Background()
+	gaugeOnly, both := prefix+"GaugeOnly", prefix+"Both"
+
+	require.NoError(t, s.UpdateGaugeMetrics(ctx, gaugeOnly, "1"))
+	_, err := s.GetCounterMetrics(ctx, gaugeOnly)
+	assert.ErrorIs(t, err, repositories.ErrMetricNotFound)
+
+	require.NoError(t, s.UpdateGaugeMetrics(ctx, both, "2.5"))
+	_, err = s.UpdateCounterMetrics(ctx, both, "7")
+	require.NoError(t, err)
+
+	g, err := s.GetGaugeMetrics(ctx, both)
+	require.NoError(t, err)
+	assert.Equal(t, "2.5", g)
+
+	c, err := s.GetCounterMetrics(ctx, both)
+	require.NoError(t, err)
+	assert.Equal(t, "7", c)
+}
+
+func testBatch(t *testing.T, s repositories.Storage, prefix string) {
+	ctx := context.Background()
+	gaugeName, counterName := prefix+"Alloc", prefix+"PollCount"
+
+	_, err := s.UpdateCounterMetrics(ctx, counterName, "10")
+	require.NoError(t, err)
+
+	// Within a batch counters add up and the last gauge value wins.
+	require.NoError(t, s.UpdateBatchMetrics(ctx, []repositories.Metrics{
+		testutil.Gauge(gaugeName, 1),
+		testutil.Counter(counterName, 2),
+		testutil.Gauge(gaugeName, 3),
+		testutil.Counter(counterName, 4),
+	}))
+
+	g, err := s.GetGaugeMetrics(ctx, gaugeName)
+	require.NoError(t, err)
+	assert.Equal(t, "3", g)
+
+	c, err := s.GetCounterMetrics(ctx, counterName)
+	require.NoError(t, err)
+	assert.Equal(t, "16", c)
+
+	require.NoError(t, s.UpdateBatchMetrics(ctx, nil))
+}
+
+func testBatchIsAtomic(t *testing.T, s repositories.Storage, prefix string) {
+	ctx := context.Background()
+	gaugeName, counterName := prefix+"Alloc", prefix+"PollCount"
+
+	assert.Error(t, s.UpdateBatchMetrics(ctx, []repositories.Metrics{
+		testutil.Gauge(gaugeName, 1),
+		testutil.Counter(counterName, 2),
+		{ID: prefix + "Broken", MType: "counter"},
+	}))
+
+	_, err := s.GetGaugeMetrics(ctx, gaugeName)
+	assert.ErrorIs(t, err, repositories.ErrMetricNotFound)
+	_, err = s.GetCounterMetrics(ctx, counterName)
+	assert.ErrorIs(t, err, repositories.ErrMetricNotFound)
+}
+
+func testList(t *testing.T, s repositories.Storage, prefix string) {
+	ctx := context.Background()
+	gaugeName, counterName := prefix+"Alloc", prefix+"PollCount"
+
+	require.NoError(t, s.UpdateBatchMetrics(ctx, []repositories.Metrics{
+		testutil.Gauge(gaugeName, 1.5),
+		testutil.Counter(counterName, 3),
+	}))
+
+	gauges, err := s.GetAllGaugeMetrics(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, gauges, testutil.Gauge(gaugeName, 1.5))
+	for _, m := range gauges {
+		assert.Equal(t, "gauge", m.MType)
+		assert.NotNil(t, m.Value)
+		assert.NotEqual(t, counterName, m.ID)
+	}
+
+	counters, err := s.GetAllCounterMetrics(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, counters, testutil.Counter(counterName, 3))
+	for _, m := range counters {
+		assert.Equal(t, "counter", m.MType)
+		assert.NotNil(t, m.Delta)
+		assert.NotEqual(t, gaugeName, m.ID)
+	}
+}
+
+func testConcurrentUpdates(t *testing.T, s repositories.Storage, prefix string) {
+	ctx := context.Background()
+	name := prefix + "PollCount"
+
+	const (
+		workers    = 8
+		increments = 50
+	)
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				if i%2 == 0 {
+					_, err := s.UpdateCounterMetrics(ctx, name, "1")
+					assert.NoError(t, err)
+					continue
+				}
+				err := s.UpdateBatchMetrics(ctx, []repositories.Metrics{
+					testutil.Counter(name, 1),
+					testutil.Gauge(fmt.Sprintf("%sGauge%d", prefix, w), float64(i)),
+				})
+				assert.NoError(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	v, err := s.GetCounterMetrics(ctx, name)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprint(workers*increments), v)
+
+	for w := 0; w < workers; w++ {
+		g, err := s.GetGaugeMetrics(ctx, fmt.Sprintf("%sGauge%d", prefix, w))
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprint(increments-1), g)
+	}
+}
+
+func testPing(t *testing.T, s repositories.Storage, prefix string) {
+	assert.NoError(t, s.Ping(context.Background()))
+}
@@ -0,0 +1,14 @@
+// Package testutil holds fixtures shared by the tests of several packages.
+package testutil
+
+import "github.com/fkocharli/metricity/internal/repositories"
+
+// Gauge returns the gauge id set to v.
+func Gauge(id string, v float64) repositories.Metrics {
+	return repositories.Metrics{ID: id, MType: "gauge", Value: &v}
+}
+
+// Counter returns the counter id incremented by d.
+func Counter(id string, d int64) repositories.Metrics {
+	return repositories.Metrics{ID: id, MType: "counter", Delta: &d}
+}
@@ -0,0 +1,493 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/atomicfile"
+	"github.com/fkocharli/metricity/internal/repositories"
+)
+
+var (
+	ErrNotFound            = errors.New("webhook subscription not found")
+	ErrInvalidSubscription = errors.New("invalid webhook subscription")
+)
+
+const (
+	// SignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the body keyed with the secret.
+	SignatureHeader = "X-Metricity-Signature"
+
+	DefaultInterval = 10 * time.Second
+	DefaultRetries  = 3
+	DefaultBackoff  = time.Second
+
+	deliveryTimeout    = 10 * time.Second
+	shutdownTimeout    = 5 * time.Second
+	subscriptionBuffer = 1024
+)
+
+// Subscription asks for the metrics matching Prefix and Type to be POSTed to URL.
+// Updates are collected over Interval and only the latest value of each metric is sent.
+type Subscription struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Prefix   string `json:"prefix,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Secret   string `json:"secret,omitempty"`
+
+	interval time.Duration
+}
+
+// Payload is the body of a delivery.
+type Payload struct {
+	Subscription string                 `json:"subscription"`
+	Time         time.Time              `json:"time"`
+	Metrics      []repositories.Metrics `json:"metrics"`
+}
+
+// DeadLetter is a delivery that failed after all retries.
+type DeadLetter struct {
+	Time         time.Time       `json:"time"`
+	Subscription string          `json:"subscription"`
+	URL          string          `json:"url"`
+	Error        string          `json:"error"`
+	Payload      json.RawMessage `json:"payload"`
+}
+
+type worker struct {
+	Subscription
+	sub    *repositories.Subscription
+	cancel context.CancelFunc
+}
+
+// Manager keeps the webhook subscriptions and delivers the metrics published by
+// Broker to them. Failed deliveries are retried Retries times with exponential
+// Backoff and then written to DeadLetters as JSON lines. Updates keep being collected
+// while a delivery is retried; those the broker drops anyway are logged. When Path is set,
+// subscriptions are saved to it and survive restarts.
+type Manager struct {
+	Path        string
+	Broker      *repositories.Broker
+	Client      *http.Client
+	Retries     int
+	Backoff     time.Duration
+	DeadLetters io.Writer
+	Mutex       *sync.RWMutex
+	workers     map[string]*worker
+	group       *sync.WaitGroup
+	ctx         context.Context
+}
+
+// New creates a manager with the subscriptions saved in path. A missing file,
+// or an empty path, gives a manager without subscriptions.
+func New(path string, b *repositories.Broker) (*Manager, error) {
+	m := &Manager{
+		Path:    path,
+		Broker:  b,
+		Client:  &http.Client{Timeout: deliveryTimeout},
+		Retries: DefaultRetries,
+		Backoff: DefaultBackoff,
+		Mutex:   &sync.RWMutex{},
+		workers: make(map[string]*worker),
+		group:   &sync.WaitGroup{},
+	}
+
+	if path == "" {
+		return m, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(bytes.TrimSpace(data)) == 0) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var subs []Subscription
+	if err := json.Unmarshal(data, &subs); err != nil {
+		return nil, fmt.Errorf("unable to parse webhook subscriptions %s: %v", path, err)
+	}
+	for _, s := range subs {
+		if err := s.validate(); err != nil {
+			return nil, err
+		}
+		m.workers[s.ID] = &worker{Subscription: s}
+	}
+
+	return m, nil
+}
+
+// Run delivers updates to the subscriptions until ctx is cancelled or the broker is closed,
+// then sends the updates collected since the last delivery.
+func (m *Manager) Run(ctx context.Context) {
+	m.Mutex.Lock()
+	m.ctx = ctx
+	for _, w := range m.workers {
+		m.start(w)
+	}
+	m.Mutex.Unlock()
+
+	<-ctx.Done()
+	m.group.Wait()
+}
+
+// Add validates s, assigns it an ID and starts delivering to it.
+func (m *Manager) Add(s Subscription) (Subscription, error) {
+	if err := s.validate(); err != nil {
+		return Subscription{}, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return Subscription{}, err
+	}
+	s.ID = id
+
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	w := &worker{Subscription: s}
+	m.workers[s.ID] = w
+	if err := m.save(); err != nil {
+		delete(m.workers, s.ID)
+		return Subscription{}, err
+	}
+	if m.ctx != nil {
+		m.start(w)
+	}
+
+	return s, nil
+}
+
+func (m *Manager) Get(id string) (Subscription, bool) {
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+
+	w, ok := m.workers[id]
+	if !ok {
+		return Subscription{}, false
+	}
+	return w.Subscription, true
+}
+
+// All returns the subscriptions ordered by ID.
+func (m *Manager) All() []Subscription {
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+
+	res := make([]Subscription, 0, len(m.workers))
+	for _, w := range m.workers {
+		res = append(res, w.Subscription)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+
+	return res
+}
+
+// Delete stops delivering to the subscription; updates collected so far are dropped.
+func (m *Manager) Delete(id string) error {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	w, ok := m.workers[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(m.workers, id)
+
+	if err := m.save(); err != nil {
+		m.workers[id] = w
+		return err
+	}
+	if w.cancel != nil {
+		w.cancel()
+		w.sub.Close()
+	}
+
+	return nil
+}
+
+func (m *Manager) start(w *worker) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	w.cancel = cancel
+	w.sub = m.Broker.Subscribe(repositories.Filter{Prefix: w.Prefix, Type: w.Type}, subscriptionBuffer)
+
+	m.group.Add(1)
+	go func() {
+		defer m.group.Done()
+		m.run(ctx, w.Subscription, w.sub)
+	}()
+}
+
+func (m *Manager) run(ctx context.Context, s Subscription, sub *repositories.Subscription) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	// Deliveries run in the background and updates keep being merged into pending
+	// meanwhile, so a receiver that is down and retried doesn't leave sub.C to fill up.
+	var (
+		pending  = make(map[string]repositories.Metrics)
+		done     = make(chan struct{}, 1)
+		inFlight bool
+		dropped  uint64
+	)
+	wait := func() {
+		if inFlight {
+			<-done
+			inFlight = false
+		}
+		dropped = m.reportDropped(s, sub, dropped)
+	}
+	defer wait()
+
+	for {
+		select {
+		case metric, ok := <-sub.C:
+			if !ok {
+				// The broker is closed on shutdown, a deleted subscription has its
+				// context cancelled first and drops what was collected.
+				if ctx.Err() == nil || m.ctx.Err() != nil {
+					wait()
+					m.flushOnShutdown(s, pending)
+				}
+				return
+			}
+			pending[metric.MType+":"+metric.ID] = metric
+		case <-done:
+			inFlight = false
+		case <-ticker.C:
+			dropped = m.reportDropped(s, sub, dropped)
+			if inFlight || len(pending) == 0 {
+				continue
+			}
+			batch := pending
+			pending = make(map[string]repositories.Metrics)
+			inFlight = true
+			go func() {
+				m.flush(ctx, s, batch)
+				done <- struct{}{}
+			}()
+		case <-ctx.Done():
+			if m.ctx.Err() == nil {
+				return
+			}
+			for drained := false; !drained; {
+				select {
+				case metric, ok := <-sub.C:
+					if ok {
+						pending[metric.MType+":"+metric.ID] = metric
+					}
+					drained = !ok
+				default:
+					drained = true
+				}
+			}
+			wait()
+			m.flushOnShutdown(s, pending)
+			return
+		}
+	}
+}
+
+// reportDropped logs the updates the broker discarded since the last call, which
+// happens when they come in faster than they are collected. It returns the new total.
+func (m *Manager) reportDropped(s Subscription, sub *repositories.Subscription, reported uint64) uint64 {
+	dropped := sub.Dropped()
+	if dropped > reported {
+		log.Printf("Webhook %s lost %d updates to %s that came in faster than they were collected", s.ID, dropped-reported, s.URL)
+	}
+	return dropped
+}
+
+// flushOnShutdown sends what was collected so far. The manager context is done by
+// then, so the last delivery gets a context of its own bounded by shutdownTimeout.
+func (m *Manager) flushOnShutdown(s Subscription, pending map[string]repositories.Metrics) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	m.flush(ctx, s, pending)
+}
+
+func (m *Manager) flush(ctx context.Context, s Subscription, pending map[string]repositories.Metrics) {
+	if len(pending) == 0 || ctx.Err() != nil {
+		return
+	}
+
+	p := Payload{
+		Subscription: s.ID,
+		Time:         time.Now().UTC(),
+		Metrics:      make([]repositories.Metrics, 0, len(pending)),
+	}
+	for _, metric := range pending {
+		p.Metrics = append(p.Metrics, metric)
+	}
+	sort.Slice(p.Metrics, func(i, j int) bool {
+		if p.Metrics[i].MType != p.Metrics[j].MType {
+			return p.Metrics[i].MType > p.Metrics[j].MType
+		}
+		return p.Metrics[i].ID < p.Metrics[j].ID
+	})
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("Unable to marshal webhook payload. Error: %v", err)
+		return
+	}
+
+	if err := m.deliver(ctx, s, body); err != nil {
+		m.deadLetter(s, body, err)
+	}
+}
+
+// deliver POSTs body to the subscription, retrying on network errors, 5xx, 408 and 429.
+func (m *Manager) deliver(ctx context.Context, s Subscription, body []byte) error {
+	var err error
+	for i := 0; i <= m.Retries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(m.Backoff << (i - 1)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		var retry bool
+		retry, err = m.post(ctx, s, body)
+		if err == nil || !retry {
+			return err
+		}
+		log.Printf("Unable to deliver webhook %s, attempt %d. Error: %v", s.ID, i+1, err)
+	}
+
+	return err
+}
+
+func (m *Manager) post(ctx context.Context, s Subscription, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(body, s.Secret))
+	}
+
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("webhook %s responded with %s", s.URL, resp.Status)
+	default:
+		return false, fmt.Errorf("webhook %s responded with %s", s.URL, resp.Status)
+	}
+}
+
+func (m *Manager) deadLetter(s Subscription, body []byte, err error) {
+	log.Printf("Giving up on webhook %s delivery to %s. Error: %v", s.ID, s.URL, err)
+	if m.DeadLetters == nil {
+		return
+	}
+
+	b, merr := json.Marshal(DeadLetter{
+		Time:         time.Now().UTC(),
+		Subscription: s.ID,
+		URL:          s.URL,
+		Error:        err.Error(),
+		Payload:      body,
+	})
+	if merr != nil {
+		log.Printf("Unable to marshal dead letter. Error: %v", merr)
+		return
+	}
+
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	if _, err := m.DeadLetters.Write(append(b, '\n')); err != nil {
+		log.Printf("Unable to write dead letter. Error: %v", err)
+	}
+}
+
+// Sign returns the hex HMAC-SHA256 of body keyed with secret, as sent in SignatureHeader.
+func Sign(body []byte, secret string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s *Subscription) validate() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: invalid url %q", ErrInvalidSubscription, s.URL)
+	}
+
+	switch s.Type {
+	case "", "gauge", "counter":
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidSubscription, s.Type)
+	}
+
+	s.interval = DefaultInterval
+	if s.Interval != "" {
+		d, err := time.ParseDuration(s.Interval)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("%w: invalid interval %q", ErrInvalidSubscription, s.Interval)
+		}
+		s.interval = d
+	}
+
+	return nil
+}
+
+// save writes the subscriptions to a temporary file and renames it over Path.
+// The file holds the secrets, so it's only readable by the owner.
+func (m *Manager) save() error {
+	if m.Path == "" {
+		return nil
+	}
+
+	subs := make([]Subscription, 0, len(m.workers))
+	for _, w := range m.workers {
+		subs = append(subs, w.Subscription)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+
+	b, err := json.MarshalIndent(subs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteBytes(m.Path, b)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,259 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fkocharli/metricity/internal/repositories"
+	"github.com/fkocharli/metricity/internal/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type delivery struct {
+	Payload   Payload
+	Signature string
+}
+
+// standIn is a webhook receiver answering with the given statuses in turn, then 200.
+type standIn struct {
+	*httptest.Server
+	Mutex      *sync.Mutex
+	statuses   []int
+	deliveries []delivery
+	attempts   int
+}
+
+func newStandIn(t *testing.T, statuses ...int) *standIn {
+	s := &standIn{Mutex: &sync.Mutex{}, statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		s.Mutex.Lock()
+		defer s.Mutex.Unlock()
+
+		s.attempts++
+		if len(s.statuses) > 0 {
+			status := s.statuses[0]
+			s.statuses = s.statuses[1:]
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+		}
+
+		var p Payload
+		require.NoError(t, json.Unmarshal(body, &p))
+		s.deliveries = append(s.deliveries, delivery{Payload: p, Signature: r.Header.Get(SignatureHeader)})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *standIn) received() []delivery {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	return append([]delivery(nil), s.deliveries...)
+}
+
+func run(t *testing.T, m *Manager) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestDelivery(t *testing.T) {
+	receiver := newStandIn(t)
+	broker := repositories.NewBroker()
+	m, err := New("", broker)
+	require.NoError(t, err)
+	run(t, m)
+
+	sub, err := m.Add(Subscription{URL: receiver.URL, Prefix: "Heap", Interval: "50ms", Secret: "s3cret"})
+	require.NoError(t, err)
+	require.NotEmpty(t, sub.ID)
+	require.Eventually(t, broker.HasSubscribers, time.Second, 10*time.Millisecond)
+
+	broker.Publish(testutil.Gauge("HeapAlloc", 1), testutil.Gauge("Alloc", 5), testutil.Counter("HeapCount", 3), testutil.Gauge("HeapAlloc", 2))
+
+	require.Eventually(t, func() bool { return len(receiver.received()) == 1 }, time.Second, 10*time.Millisecond)
+	d := receiver.received()[0]
+	assert.Equal(t, sub.ID, d.Payload.Subscription)
+	require.Len(t, d.Payload.Metrics, 2)
+	assert.Equal(t, "HeapAlloc", d.Payload.Metrics[0].ID)
+	assert.Equal(t, 2.0, *d.Payload.Metrics[0].Value)
+	assert.Equal(t, "HeapCount", d.Payload.Metrics[1].ID)
+	assert.Equal(t, int64(3), *d.Payload.Metrics[1].Delta)
+
+	body, err := json.Marshal(d.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, "sha256="+Sign(body, "s3cret"), d.Signature)
+
+	// Nothing is sent while nothing changes and after the subscription is deleted.
+	time.Sleep(150 * time.Millisecond)
+	require.NoError(t, m.Delete(sub.ID))
+	broker.Publish(testutil.Gauge("HeapAlloc", 3))
+	time.Sleep(150 * time.Millisecond)
+	assert.Len(t, receiver.received(), 1)
+	assert.False(t, broker.HasSubscribers())
+	assert.Equal(t, ErrNotFound, m.Delete(sub.ID))
+}
+
+func TestFlushOnShutdown(t *testing.T) {
+	for _, closeBroker := range []bool{true, false} {
+		receiver := newStandIn(t)
+		broker := repositories.NewBroker()
+		m, err := New("", broker)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			m.Run(ctx)
+		}()
+
+		_, err = m.Add(Subscription{URL: receiver.URL, Interval: "1h"})
+		require.NoError(t, err)
+		require.Eventually(t, broker.HasSubscribers, time.Second, 10*time.Millisecond)
+		broker.Publish(testutil.Gauge("Alloc", 1))
+
+		// The server closes the broker and then cancels the context; either one
+		// ends delivery, and what was collected is still sent.
+		if closeBroker {
+			broker.Close()
+		}
+		cancel()
+		<-done
+
+		require.Len(t, receiver.received(), 1, "broker closed: %v", closeBroker)
+		assert.Equal(t, "Alloc", receiver.received()[0].Payload.Metrics[0].ID)
+	}
+}
+
+func TestRetriesAndDeadLetters(t *testing.T) {
+	broker := repositories.NewBroker()
+	var deadLetters bytes.Buffer
+	m, err := New("", broker)
+	require.NoError(t, err)
+	m.Backoff = time.Millisecond
+	m.DeadLetters = &deadLetters
+	run(t, m)
+
+	flaky := newStandIn(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	_, err = m.Add(Subscription{URL: flaky.URL, Interval: "20ms"})
+	require.NoError(t, err)
+
+	rejecting := newStandIn(t, http.StatusBadRequest)
+	rejected, err := m.Add(Subscription{URL: rejecting.URL, Interval: "20ms"})
+	require.NoError(t, err)
+
+	require.Eventually(t, broker.HasSubscribers, time.Second, 10*time.Millisecond)
+	broker.Publish(testutil.Gauge("Alloc", 1))
+
+	require.Eventually(t, func() bool { return len(flaky.received()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 3, flaky.attempts)
+
+	require.Eventually(t, func() bool {
+		m.Mutex.RLock()
+		defer m.Mutex.RUnlock()
+		return deadLetters.Len() > 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, rejecting.attempts)
+
+	var dl DeadLetter
+	m.Mutex.RLock()
+	require.NoError(t, json.Unmarshal(deadLetters.Bytes(), &dl))
+	m.Mutex.RUnlock()
+	assert.Equal(t, rejected.ID, dl.Subscription)
+	assert.Equal(t, rejecting.URL, dl.URL)
+	assert.Contains(t, dl.Error, "400")
+
+	var p Payload
+	require.NoError(t, json.Unmarshal(dl.Payload, &p))
+	assert.Equal(t, "Alloc", p.Metrics[0].ID)
+}
+
+func TestCollectingWhileRetrying(t *testing.T) {
+	broker := repositories.NewBroker()
+	m, err := New("", broker)
+	require.NoError(t, err)
+	m.Backoff = 50 * time.Millisecond
+	run(t, m)
+
+	receiver := newStandIn(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	sub, err := m.Add(Subscription{URL: receiver.URL, Interval: "10ms"})
+	require.NoError(t, err)
+	require.Eventually(t, broker.HasSubscribers, time.Second, 10*time.Millisecond)
+
+	broker.Publish(testutil.Gauge("Alloc", 0))
+	require.Eventually(t, func() bool {
+		receiver.Mutex.Lock()
+		defer receiver.Mutex.Unlock()
+		return receiver.attempts > 0
+	}, time.Second, time.Millisecond)
+
+	// While the first delivery is retried, more updates come in than the subscription buffers.
+	for i := 1; i <= 2*subscriptionBuffer; i++ {
+		broker.Publish(testutil.Gauge("Alloc", float64(i)))
+		if i%100 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		d := receiver.received()
+		return len(d) > 0 && *d[len(d)-1].Payload.Metrics[0].Value == 2*subscriptionBuffer
+	}, time.Second, 10*time.Millisecond)
+	m.Mutex.RLock()
+	assert.Zero(t, m.workers[sub.ID].sub.Dropped())
+	m.Mutex.RUnlock()
+}
+
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	m, err := New(path, repositories.NewBroker())
+	require.NoError(t, err)
+
+	a, err := m.Add(Subscription{URL: "http://localhost:9000/a", Type: "gauge", Secret: "x"})
+	require.NoError(t, err)
+	b, err := m.Add(Subscription{URL: "https://example.com/b", Interval: "1m"})
+	require.NoError(t, err)
+	require.NoError(t, m.Delete(b.ID))
+
+	loaded, err := New(path, repositories.NewBroker())
+	require.NoError(t, err)
+	got := loaded.All()
+	require.Len(t, got, 1)
+	assert.Equal(t, a, got[0])
+
+	invalid := []Subscription{
+		{URL: "localhost:9000"},
+		{URL: "ftp://example.com"},
+		{URL: "http://example.com", Type: "histogram"},
+		{URL: "http://example.com", Interval: "0s"},
+		{URL: "http://example.com", Interval: "soon"},
+	}
+	for _, s := range invalid {
+		_, err := m.Add(s)
+		assert.True(t, errors.Is(err, ErrInvalidSubscription), "%+v", s)
+	}
+}